@@ -0,0 +1,119 @@
+package main
+
+// Cursor walks through an UndoLog in both directions without changing it,
+// i.e. readOffset and writeOffset of the log are left untouched.
+// A walk sees the log as it is when the cursor is created or moved by SeekStart
+// or SeekEnd: items written later are not visible, items popped later can no
+// longer be read. A Cursor is used by one goroutine, each one creates its own.
+type Cursor struct {
+	log    *UndoLog
+	end    int64 // writeOffset of log when snapshot is taken
+	last   int64 // offset of the last item when snapshot is taken, -1 if none
+	offset int64 // offset of current item, -1 if cursor is not positioned yet
+	item   *UndoItem
+}
+
+// Cursor returns a new cursor over l, which is not positioned yet.
+// The first call to Next moves it to the first item, and Prev to the last one.
+func (l *UndoLog) Cursor() *Cursor {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return &Cursor{log: l, end: l.writeOffset, last: l.readOffset, offset: -1}
+}
+
+// snapshot takes end of log for the walks to come
+func (c *Cursor) snapshot() {
+	c.end = c.log.writeOffset
+	c.last = c.log.readOffset
+}
+
+// Offset returns offset of current item, -1 if cursor is not positioned yet
+func (c *Cursor) Offset() int64 {
+	return c.offset
+}
+
+// Item returns current item, nil if cursor is not positioned yet
+func (c *Cursor) Item() *UndoItem {
+	return c.item
+}
+
+// SeekStart moves to the first item, return nil if the log is empty
+func (c *Cursor) SeekStart() (*UndoItem, error) {
+	c.log.mu.RLock()
+	defer c.log.mu.RUnlock()
+	c.snapshot()
+	if c.last == -1 {
+		return nil, nil
+	}
+	return c.seek(c.log.firstItemOffset())
+}
+
+// SeekEnd moves to the last item, return nil if the log is empty
+func (c *Cursor) SeekEnd() (*UndoItem, error) {
+	c.log.mu.RLock()
+	defer c.log.mu.RUnlock()
+	c.snapshot()
+	if c.last == -1 {
+		return nil, nil
+	}
+	return c.seek(c.last)
+}
+
+// SeekTo moves to the item at offset, which must be the start of an item.
+func (c *Cursor) SeekTo(offset int64) (*UndoItem, error) {
+	c.log.mu.RLock()
+	defer c.log.mu.RUnlock()
+	return c.seek(offset)
+}
+
+// SeekLSN moves to the item with lsn, ErrUnknownLSN if there is none
+func (c *Cursor) SeekLSN(lsn int64) (*UndoItem, error) {
+	c.log.mu.RLock()
+	defer c.log.mu.RUnlock()
+	if c.log.closed {
+		return nil, ErrLogClosed
+	}
+	offset, err := c.log.offsetOf(lsn)
+	if err != nil {
+		return nil, err
+	}
+	return c.seek(offset)
+}
+
+func (c *Cursor) seek(offset int64) (*UndoItem, error) {
+	if c.log.closed {
+		return nil, ErrLogClosed
+	}
+	if offset < c.log.firstItemOffset() || offset >= c.end || offset >= c.log.writeOffset {
+		return nil, errOffsetOutOfRange
+	}
+	item, err := c.log.readAt(offset)
+	if err != nil {
+		return nil, err
+	}
+	c.offset = offset
+	c.item = item
+	return item, nil
+}
+
+// Next moves to the item after current one, return nil and stay if current one is the last.
+func (c *Cursor) Next() (*UndoItem, error) {
+	if c.item == nil {
+		return c.SeekStart()
+	}
+	if c.item.NextOffset() >= c.end {
+		return nil, nil
+	}
+	return c.SeekTo(c.item.NextOffset())
+}
+
+// Prev moves to the item before current one, return nil and stay if current one is the first.
+func (c *Cursor) Prev() (*UndoItem, error) {
+	if c.item == nil {
+		return c.SeekEnd()
+	}
+	if c.item.PrevOffset() == -1 {
+		return nil, nil
+	}
+	return c.SeekTo(c.item.PrevOffset())
+}
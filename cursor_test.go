@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+	os.Remove("./test.bin")
+	log := NewUndoLog("./test.bin")
+	defer log.Close()
+
+	cursor := log.Cursor()
+	if item, err := cursor.Next(); item != nil || err != nil {
+		t.Errorf("cursor over empty log returns %v, %v", item, err)
+	}
+
+	origins := []UndoItem{
+		{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10},
+		{Cmd: commit, TranscationID: 0x1},
+		{Cmd: write, TranscationID: 0x2, FromID: 2, FromCash: 100, ToID: 3, ToCash: 0, Cash: 20},
+		{Cmd: commit, TranscationID: 0x2},
+	}
+	offsets := make([]int64, 0, len(origins))
+	for _, item := range origins {
+		offsets = append(offsets, log.writeOffset)
+		if err := log.Write(&item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readOffset, writeOffset := log.readOffset, log.writeOffset
+
+	for idx := 0; ; idx++ {
+		item, err := cursor.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item == nil {
+			if idx != len(origins) {
+				t.Errorf("forward walk stops at %d", idx)
+			}
+			break
+		}
+		if cursor.Offset() != offsets[idx] || item.TranscationID != origins[idx].TranscationID || item.Cmd != origins[idx].Cmd {
+			t.Errorf("forward walk item %d does not match origin", idx)
+		}
+	}
+
+	if item, _ := cursor.SeekEnd(); item == nil || cursor.Offset() != offsets[3] {
+		t.Error("seek end failed")
+	}
+	for idx := 2; idx >= 0; idx-- {
+		item, err := cursor.Prev()
+		if err != nil || item == nil {
+			t.Fatalf("backward walk failed at %d, %v", idx, err)
+		}
+		if cursor.Offset() != offsets[idx] || item.TranscationID != origins[idx].TranscationID {
+			t.Errorf("backward walk item %d does not match origin", idx)
+		}
+	}
+	if item, err := cursor.Prev(); item != nil || err != nil {
+		t.Error("backward walk does not stop at the first item")
+	}
+
+	if item, err := cursor.SeekTo(offsets[2]); err != nil || item.FromID != 2 {
+		t.Errorf("seek to offset failed, %v", err)
+	}
+	if _, err := cursor.SeekTo(writeOffset); err != errOffsetOutOfRange {
+		t.Errorf("seek out of range returns %v", err)
+	}
+
+	if log.readOffset != readOffset || log.writeOffset != writeOffset {
+		t.Error("cursor changes offsets of log")
+	}
+	if item, err := log.Read(); err != nil || item.Cmd != commit || item.TranscationID != 0x2 {
+		t.Errorf("read after walking does not return the last item, %v", err)
+	}
+}
+
+func TestCursorSeekLSN(t *testing.T) {
+	os.Remove("./test.bin")
+	log := NewUndoLog("./test.bin")
+	defer log.Close()
+	items := []*UndoItem{
+		{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, Cash: 10},
+		{Cmd: commit, TranscationID: 0x1},
+		{Cmd: write, TranscationID: 0x2, FromID: 2, FromCash: 100, ToID: 3, Cash: 20},
+	}
+	for _, item := range items {
+		log.Write(item)
+	}
+	log.Pop() // LSN of the popped item is not given again
+	items[2].TranscationID = 0x3
+	log.Write(items[2])
+
+	c := log.Cursor()
+	if item, err := c.SeekLSN(items[1].LSN()); err != nil || item.Cmd != commit {
+		t.Errorf("seek to LSN %d gives %v, %v", items[1].LSN(), item, err)
+	}
+	if item, err := c.Next(); err != nil || item.LSN() != 4 || item.TranscationID != 0x3 {
+		t.Errorf("item after LSN 2 is %v, %v", item, err)
+	}
+	if _, err := c.SeekLSN(3); err != ErrUnknownLSN {
+		t.Errorf("seek to a popped LSN returns %v", err)
+	}
+}
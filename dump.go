@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// cmdNames are names of item types printed by dump
+var cmdNames = map[cmdType]string{
+	write:      "write",
+	commit:     "commit",
+	abort:      "abort",
+	begin:      "begin",
+	savepoint:  "savepoint",
+	revert:     "revert",
+	delta:      "delta",
+	checkpoint: "checkpoint",
+	rollbackTo: "rollback_to",
+}
+
+func cmdName(cmd cmdType) string {
+	if name, ok := cmdNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%#x)", uint32(cmd))
+}
+
+// dumpFilter selects items printed by dump, -1 matches all
+type dumpFilter struct {
+	transcationID int
+	userID        int
+}
+
+func (f dumpFilter) match(item *UndoItem) bool {
+	if f.transcationID >= 0 && item.TranscationID != f.transcationID {
+		return false
+	}
+	if f.userID >= 0 && !(isChange(item.Cmd) && (item.FromID == f.userID || item.ToID == f.userID)) {
+		return false
+	}
+	return true
+}
+
+// dumpHeader is a header printed by dump, a JSON line
+type dumpHeader struct {
+	Segment          string `json:"segment"`
+	Magic            string `json:"magic"`
+	Version          int    `json:"version"`
+	NextItemOffset   int64  `json:"first"`
+	EndingItemOffset int64  `json:"ending"`
+	Size             int64  `json:"size"`
+	NextLSN          int64  `json:"next_lsn,omitempty"`
+}
+
+// dumpItem is an item printed by dump, a JSON line. Offsets are as stored in
+// file, not fixed up as Read does.
+type dumpItem struct {
+	Offset        int64  `json:"offset"`
+	Type          string `json:"type"`
+	Next          int64  `json:"next"`
+	Prev          int64  `json:"prev"`
+	LSN           int64  `json:"lsn,omitempty"`
+	TranscationID int    `json:"transcation_id"`
+	FromID        *int   `json:"from_id,omitempty"`
+	FromCash      *int   `json:"from_cash,omitempty"`
+	ToID          *int   `json:"to_id,omitempty"`
+	ToCash        *int   `json:"to_cash,omitempty"`
+	Cash          *int   `json:"cash,omitempty"`
+	FromAfter     *int   `json:"from_after,omitempty"`
+	ToAfter       *int   `json:"to_after,omitempty"`
+}
+
+// runDump is the dump subcommand: undo_log dump [-json] [-tx id] [-user id] [file]
+func runDump(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON lines instead of text")
+	filter := dumpFilter{}
+	fs.IntVar(&filter.transcationID, "tx", -1, "print items of this transcation only")
+	fs.IntVar(&filter.userID, "user", -1, "print items changing cash of this user only")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := defaultLogPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	l, problems, err := openLogReadOnly(path)
+	if err != nil {
+		return err
+	}
+	defer l.closeSegments()
+	if len(problems) > 0 {
+		return errors.New(problems[0].String())
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	return l.dump(w, *asJSON, filter)
+}
+
+// openLogReadOnly opens segments of a log to inspect, nothing is written to
+// them: no recovery, and header is not updated. A header which fails its
+// checksum or magic is rebuilt by rebuildHeader and returned as a problem.
+func openLogReadOnly(path string) (*UndoLog, []logProblem, error) {
+	l := &UndoLog{fileName: path}
+	paths, err := l.readManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	var problems []logProblem
+	prevEnd := int64(0) // end of the previous segment file
+	for _, p := range paths {
+		file, err := os.Open(p)
+		if err != nil {
+			l.closeSegments()
+			return nil, nil, err
+		}
+		s := &segment{path: p, file: file}
+		l.segments = append(l.segments, s)
+		if s.header, err = l.readSegmentHeader(file); err != nil {
+			if s.header = rebuildHeader(file, prevEnd); s.header == nil {
+				l.closeSegments()
+				return nil, nil, fmt.Errorf("%s: %w", p, err)
+			}
+			var corruption *CorruptionError
+			if errors.As(err, &corruption) {
+				err = corruption.Err
+			}
+			problems = append(problems, logProblem{p, -1, err.Error()})
+		}
+		size, err := s.size()
+		if err != nil {
+			l.closeSegments()
+			return nil, nil, err
+		}
+		prevEnd = s.base() + size
+	}
+	return l, problems, nil
+}
+
+// dump prints header of every segment and the items matching filter. Items
+// are decoded up to the end of each file, so items written after the header
+// was last updated are printed as well. It stops at the first corrupt item.
+func (l *UndoLog) dump(w io.Writer, asJSON bool, filter dumpFilter) error {
+	enc := json.NewEncoder(w)
+	for _, s := range l.segments {
+		h := s.header
+		if asJSON {
+			err := enc.Encode(dumpHeader{s.path, fmt.Sprintf("%#x", uint32(h.Magic)), h.Version, h.NextItemOffset, h.EndingItemOffset, h.Size, h.NextLSN})
+			if err != nil {
+				return err
+			}
+		} else {
+			printHeader(w, s)
+		}
+		size, err := s.size()
+		if err != nil {
+			return err
+		}
+		for offset := h.NextItemOffset; offset < s.base()+size; {
+			item, err := readRaw(s, offset)
+			if err != nil {
+				return err
+			}
+			if filter.match(item) {
+				if err := printItem(w, enc, asJSON, offset, item); err != nil {
+					return err
+				}
+			}
+			offset += itemSize(item.Cmd, h.Version)
+		}
+	}
+	return nil
+}
+
+// readRaw reads the item at offset of segment as it is stored, unlike
+// UndoLog.readAt, next and prev are not fixed up. The item is returned along
+// with a checksum mismatch, its type is known.
+func readRaw(s *segment, offset int64) (*UndoItem, error) {
+	r := io.NewSectionReader(s.file, offset-s.base(), maxItemSize)
+	item := &UndoItem{}
+	_, err := item.FromBinary(r, s.header.Version)
+	if _, ok := cmdNames[item.Cmd]; !ok && (err == nil || err == errChecksumMismatch) {
+		err = errUnknownItem
+	}
+	if err == errChecksumMismatch {
+		return item, newCorruptionError(offset, err)
+	}
+	if err != nil {
+		return nil, newCorruptionError(offset, err)
+	}
+	return item, nil
+}
+
+func printHeader(w io.Writer, s *segment) {
+	h := s.header
+	fmt.Fprintf(w, "segment %s version %d first %d ending %d size %d next_lsn %d\n",
+		s.path, h.Version, h.NextItemOffset, h.EndingItemOffset, h.Size, h.NextLSN)
+}
+
+func printItem(w io.Writer, enc *json.Encoder, asJSON bool, offset int64, item *UndoItem) error {
+	if asJSON {
+		d := dumpItem{Offset: offset, Type: cmdName(item.Cmd), Next: item.next, Prev: item.prev, LSN: item.lsn, TranscationID: item.TranscationID}
+		if hasValues(item.Cmd) {
+			d.FromID, d.FromCash, d.ToID, d.ToCash, d.Cash = &item.FromID, &item.FromCash, &item.ToID, &item.ToCash, &item.Cash
+			if item.lsn != 0 {
+				d.FromAfter, d.ToAfter = &item.FromAfter, &item.ToAfter
+			}
+		}
+		return enc.Encode(d)
+	}
+	_, err := fmt.Fprintf(w, "%d\t%s\tnext %d prev %d lsn %d tx %d", offset, cmdName(item.Cmd), item.next, item.prev, item.lsn, item.TranscationID)
+	if err == nil && hasValues(item.Cmd) {
+		_, err = fmt.Fprintf(w, " from %d:%d to %d:%d cash %d", item.FromID, item.FromCash, item.ToID, item.ToCash, item.Cash)
+		if err == nil && item.lsn != 0 {
+			_, err = fmt.Fprintf(w, " after %d:%d", item.FromAfter, item.ToAfter)
+		}
+	}
+	if err == nil {
+		_, err = fmt.Fprintln(w)
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	removeLog("./dump.bin")
+	defer removeLog("./dump.bin")
+	log := NewUndoLog("./dump.bin", Options{SegmentSize: 100})
+	log.Write(&UndoItem{Cmd: write, TranscationID: 1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10})
+	log.Write(&UndoItem{Cmd: commit, TranscationID: 1})
+	log.Write(&UndoItem{Cmd: write, TranscationID: 2, FromID: 2, FromCash: 10, ToID: 3, ToCash: 0, Cash: 5})
+	log.Write(&UndoItem{Cmd: commit, TranscationID: 2})
+	log.Close()
+
+	var out bytes.Buffer
+	if err := runDump([]string{"./dump.bin"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out.String(), "\n"); n < 5 {
+		t.Errorf("text dump has %d lines:\n%s", n, out.String())
+	}
+	if !strings.Contains(out.String(), "write\tnext") || !strings.Contains(out.String(), "from 2:10 to 3:0 cash 5") {
+		t.Errorf("text dump is\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runDump([]string{"-json", "-tx", "2", "./dump.bin"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var d dumpItem
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			t.Fatal(err)
+		}
+		if d.Type == "" {
+			continue // header
+		}
+		if d.TranscationID != 2 {
+			t.Errorf("item of transcation %d is not filtered", d.TranscationID)
+		}
+		types = append(types, d.Type)
+	}
+	if strings.Join(types, ",") != "write,commit" {
+		t.Errorf("items dumped are %v", types)
+	}
+
+	out.Reset()
+	if err := runDump([]string{"-json", "-user", "1", "./dump.bin"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out.String(), `"type":"write"`); n != 1 || !strings.Contains(out.String(), `"from_id":1`) {
+		t.Errorf("items of user 1 dumped are\n%s", out.String())
+	}
+}
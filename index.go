@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// indexEntry locates the items of a transcation in file
+type indexEntry struct {
+	TranscationID int
+	Write         int64 // offset of the first item, begin or write
+	Commit        int64 // offset of commit or abort item, -1 if not commited
+}
+
+// txIndex maps TranscationID to its entries, in the order they were written.
+// A TranscationID may be written more than once, the last entry wins.
+type txIndex map[int][]indexEntry
+
+func (x txIndex) add(offset int64, item *UndoItem) {
+	entries := x[item.TranscationID]
+	n := len(entries)
+	switch item.Cmd {
+	case begin:
+	case savepoint, revert, checkpoint, rollbackTo:
+		return
+	case write, delta:
+		if n > 0 && entries[n-1].Commit == -1 {
+			return // one more write of an open transcation
+		}
+	default:
+		if n > 0 {
+			entries[n-1].Commit = offset
+		}
+		return
+	}
+	x[item.TranscationID] = append(entries, indexEntry{item.TranscationID, offset, -1})
+}
+
+func (x txIndex) remove(offset int64, item *UndoItem) {
+	entries := x[item.TranscationID]
+	n := len(entries)
+	if n == 0 {
+		return
+	}
+	switch offset {
+	case entries[n-1].Commit:
+		entries[n-1].Commit = -1
+	case entries[n-1].Write:
+		if n == 1 {
+			delete(x, item.TranscationID)
+		} else {
+			x[item.TranscationID] = entries[:n-1]
+		}
+	}
+}
+
+// hasUncommited tells if any transcation written in [from, to) is not commited
+func (x txIndex) hasUncommited(from, to int64) bool {
+	for _, e := range x {
+		last := e[len(e)-1]
+		if last.Commit == -1 && last.Write >= from && last.Write < to {
+			return true
+		}
+	}
+	return false
+}
+
+// dropBefore removes entries whose first item is before offset
+func (x txIndex) dropBefore(offset int64) {
+	for id, e := range x {
+		kept := e[:0]
+		for _, entry := range e {
+			if entry.Write >= offset {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) == 0 {
+			delete(x, id)
+		} else {
+			x[id] = kept
+		}
+	}
+}
+
+// uncommited returns entries without a commit item, ordered by offset
+func (x txIndex) uncommited() []indexEntry {
+	var entries []indexEntry
+	for _, e := range x {
+		if e[len(e)-1].Commit == -1 {
+			entries = append(entries, e[len(e)-1])
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Write < entries[j].Write })
+	return entries
+}
+
+// Lookup returns offset of the first item, begin or write, of transcationID
+func (l *UndoLog) Lookup(transcationID int) (int64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entries, ok := l.index[transcationID]
+	if !ok {
+		return -1, false
+	}
+	return entries[len(entries)-1].Write, true
+}
+
+// Aborted returns the first items, begin or write, of aborted transcations,
+// in the order they were written
+func (l *UndoLog) Aborted() ([]*UndoItem, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	var entries []indexEntry
+	for _, e := range l.index {
+		for _, entry := range e {
+			if entry.Commit == -1 {
+				continue
+			}
+			item, err := l.readAt(entry.Commit)
+			if err != nil {
+				return nil, err
+			}
+			if item.Cmd == abort {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Write < entries[j].Write })
+	items := make([]*UndoItem, 0, len(entries))
+	for _, e := range entries {
+		item, err := l.readAt(e.Write)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Items returns items of transcationID from its first item to its commit or
+// abort item, or to the end of log if it is not commited yet
+func (l *UndoLog) Items(transcationID int) ([]*UndoItem, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	entries, ok := l.index[transcationID]
+	if !ok {
+		return nil, nil
+	}
+	e := entries[len(entries)-1]
+	var items []*UndoItem
+	for offset := e.Write; offset < l.writeOffset; {
+		item, err := l.readAt(offset)
+		if err != nil {
+			return nil, err
+		}
+		if item.TranscationID == transcationID {
+			items = append(items, item)
+		}
+		if offset == e.Commit {
+			break
+		}
+		offset = item.NextOffset()
+	}
+	return items, nil
+}
+
+// RevertedBy returns TranscationID of the commited transcation which reverts
+// transcationID, false if it is not reverted
+func (l *UndoLog) RevertedBy(transcationID int) (int, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return 0, false, ErrLogClosed
+	}
+	entries, ok := l.index[transcationID]
+	if !ok || entries[len(entries)-1].Commit == -1 {
+		return 0, false, nil
+	}
+	for offset := entries[len(entries)-1].Commit; offset < l.writeOffset; {
+		item, err := l.readAt(offset)
+		if err != nil {
+			return 0, false, err
+		}
+		if item.Reverts() == transcationID && l.commited(item.TranscationID) {
+			return item.TranscationID, true, nil
+		}
+		offset = item.NextOffset()
+	}
+	return 0, false, nil
+}
+
+// commited tells if the last transcation of transcationID ends with a commit item
+func (l *UndoLog) commited(transcationID int) bool {
+	entries, ok := l.index[transcationID]
+	if !ok || entries[len(entries)-1].Commit == -1 {
+		return false
+	}
+	item, err := l.readAt(entries[len(entries)-1].Commit)
+	return err == nil && item.Cmd == commit
+}
+
+// buildIndex indexes items from offset to the end of file, then collects pending items
+func (l *UndoLog) buildIndex(offset int64) error {
+	for offset < l.writeOffset {
+		item, err := l.readAt(offset)
+		if err != nil {
+			return err
+		}
+		l.index.add(offset, item)
+		offset = item.NextOffset()
+	}
+
+	l.pending = nil
+	for _, e := range l.index.uncommited() {
+		item, err := l.readAt(e.Write)
+		if err != nil {
+			return err
+		}
+		l.pending = append(l.pending, pendingItem{e.Write, item})
+	}
+	return nil
+}
+
+func (l *UndoLog) indexFileName() string {
+	return l.fileName + ".idx"
+}
+
+const constIndexMAGIC int32 = 0x00786475 //UDX\0
+
+// SaveIndex writes index into a sidecar file, so that next open does not need to
+// scan the whole log. Once saved, it is kept up to date on Close.
+// index file: magic:4|covered size:8|count:8|(trans:8|write:8|commit:8)*count|crc:4
+func (l *UndoLog) SaveIndex() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	return l.saveIndex()
+}
+
+func (l *UndoLog) saveIndex() error {
+	l.indexFile = true
+	tmpName := l.indexFileName() + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, l.fileMode())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	crc := crc32.New(crcTable)
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+	var entries []indexEntry
+	for _, e := range l.index {
+		entries = append(entries, e...)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Write < entries[j].Write })
+
+	binary.Write(w, binary.LittleEndian, constIndexMAGIC)
+	binary.Write(w, binary.LittleEndian, l.writeOffset)
+	binary.Write(w, binary.LittleEndian, int64(len(entries)))
+	for _, e := range entries {
+		binary.Write(w, binary.LittleEndian, []int64{int64(e.TranscationID), e.Write, e.Commit})
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = binary.Write(f, binary.LittleEndian, crc.Sum32()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, l.indexFileName())
+}
+
+// loadIndex loads the sidecar index file if there is a valid one,
+// return the size of log it covers, or 0 if log must be scanned from the beginning.
+func (l *UndoLog) loadIndex() int64 {
+	l.index = make(txIndex)
+	f, err := os.Open(l.indexFileName())
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	l.indexFile = true
+
+	crc := crc32.New(crcTable)
+	r := io.TeeReader(bufio.NewReader(f), crc)
+	var magic int32
+	var covered, count int64
+	binary.Read(r, binary.LittleEndian, &magic)
+	binary.Read(r, binary.LittleEndian, &covered)
+	if err = binary.Read(r, binary.LittleEndian, &count); err != nil || magic != constIndexMAGIC || covered > l.writeOffset {
+		return 0
+	}
+	index := make(txIndex)
+	for i := int64(0); i < count; i++ {
+		e := make([]int64, 3)
+		if err = binary.Read(r, binary.LittleEndian, e); err != nil {
+			return 0
+		}
+		id := int(e[0])
+		index[id] = append(index[id], indexEntry{id, e[1], e[2]})
+	}
+	var stored uint32
+	sum := crc.Sum32()
+	if err = binary.Read(r, binary.LittleEndian, &stored); err != nil || stored != sum {
+		return 0
+	}
+	index.dropBefore(l.firstItemOffset())
+	l.index = index
+	return covered
+}
+
+// dropIndexFile removes the sidecar index file once log is truncated, as it may
+// describe items no longer exist. It is written again on Close.
+func (l *UndoLog) dropIndexFile() {
+	if l.indexFile {
+		os.Remove(l.indexFileName())
+	}
+}
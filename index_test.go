@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	os.Remove("./test.bin")
+	os.Remove("./test.bin.idx")
+	log := NewUndoLog("./test.bin")
+	origins := []UndoItem{
+		{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10},
+		{Cmd: commit, TranscationID: 0x1},
+		{Cmd: write, TranscationID: 0x2, FromID: 2, FromCash: 100, ToID: 3, ToCash: 0, Cash: 20},
+		{Cmd: commit, TranscationID: 0x2},
+		{Cmd: write, TranscationID: 0x3, FromID: 3, FromCash: 100, ToID: 4, ToCash: 0, Cash: 30},
+	}
+	offsets := make([]int64, 0, len(origins))
+	for _, item := range origins {
+		offsets = append(offsets, log.writeOffset)
+		log.Write(&item)
+	}
+	if offset, ok := log.Lookup(0x2); !ok || offset != offsets[2] {
+		t.Errorf("lookup after write returns %d, %v", offset, ok)
+	}
+	log.Read()
+	log.Pop()
+	if _, ok := log.Lookup(0x3); ok {
+		t.Error("popped transcation is still indexed")
+	}
+	if err := log.SaveIndex(); err != nil {
+		t.Fatal(err)
+	}
+	log.Write(&origins[4])
+	log.file.Close() // index file does not cover the last item
+
+	log = NewUndoLog("./test.bin")
+	defer log.Close()
+	for idx, id := range []int{0x1, 0x2, 0x3} {
+		if offset, ok := log.Lookup(id); !ok || offset != offsets[idx*2] {
+			t.Errorf("lookup %d after reopen returns %d, %v", id, offset, ok)
+		}
+	}
+	if pending := log.Pending(); len(pending) != 1 || pending[0].TranscationID != 0x3 {
+		t.Errorf("pending after reopen is %v", pending)
+	}
+	if _, ok := log.Lookup(0x4); ok {
+		t.Error("lookup unknown transcation succeeded")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// lockManager hands out a lock per user, so that transfers between unrelated
+// users can run in parallel. It also counts open transcations, which System
+// wide operations wait for.
+type lockManager struct {
+	mu        sync.Mutex
+	locks     map[int]*sync.Mutex
+	txs       int        // open transcations
+	exclusive bool       // a System wide operation runs, no transcation opens
+	changed   *sync.Cond // on mu, signaled when txs or exclusive changes
+}
+
+func newLockManager() *lockManager {
+	m := &lockManager{locks: make(map[int]*sync.Mutex)}
+	m.changed = sync.NewCond(&m.mu)
+	return m
+}
+
+func (m *lockManager) get(id int) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[id] = l
+	}
+	return l
+}
+
+// tryLock locks user id if it is not locked, and tells if it does
+func (m *lockManager) tryLock(id int) bool {
+	return m.get(id).TryLock()
+}
+
+func (m *lockManager) unlock(id int) {
+	m.get(id).Unlock()
+}
+
+// lock locks users in ascending ID order, so that two transfers never wait for
+// each other, and returns the function to unlock them.
+func (m *lockManager) lock(ids ...int) func() {
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+	locks := make([]*sync.Mutex, 0, len(sorted))
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
+		}
+		l := m.get(id)
+		l.Lock()
+		locks = append(locks, l)
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// openTx counts a transcation open, it waits while a System wide operation runs
+func (m *lockManager) openTx() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.exclusive {
+		m.changed.Wait()
+	}
+	m.txs++
+}
+
+func (m *lockManager) closeTx() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.txs--
+	m.changed.Broadcast()
+}
+
+// exclude waits until no transcation is open, then keeps new ones from opening
+// until include. It holds no lock while waiting, so open transcations go on.
+func (m *lockManager) exclude() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.exclusive || m.txs > 0 {
+		m.changed.Wait()
+	}
+	m.exclusive = true
+}
+
+func (m *lockManager) include() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.exclusive = false
+	m.changed.Broadcast()
+}
@@ -1,79 +1,42 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"sort"
 )
 
-func main() {
-	system := NewSystem()
-	defer system.Close()
-
-	users := []*User{
-		{
-			ID:   1,
-			Name: "Tom",
-			Cash: 10,
-		},
-		{
-			ID:   2,
-			Name: "Jerry",
-			Cash: 10,
-		},
-		{
-			ID:   3,
-			Name: "Spike",
-			Cash: 10,
-		},
-	}
-	transcations := []*Transcation{
-		{
-			TranscationID: 1,
-			FromID:        1,
-			ToID:          2,
-			Cash:          10,
-		},
-		{
-			TranscationID: 2,
-			FromID:        2,
-			ToID:          3,
-			Cash:          5,
-		},
-		{
-			TranscationID: 3,
-			FromID:        3,
-			ToID:          1,
-			Cash:          20,
-		},
-		{
-			TranscationID: 4,
-			FromID:        2,
-			ToID:          1,
-			Cash:          10,
-		},
-	}
-
-	for _, user := range users {
-		if err := system.AddUser(user); err != nil {
-			log.Printf("add user failed %v", err)
-		}
-	}
+// commands are subcommands of the binary, each one gets the arguments after its name
+var commands = map[string]func(args []string, out io.Writer) error{
+	"run":    runScenario,
+	"dump":   runDump,
+	"verify": runVerify,
+	"repair": runRepair,
+	"replay": runReplay,
+	"serve":  runServe,
+}
 
-	// TODO: do transcation parallel
-	for _, transcation := range transcations {
-		if err := system.DoTransaction(transcation); err != nil {
-			log.Printf("do transcation failed %v", err)
-		}
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [arguments]\ncommands: %v\n", os.Args[0], names)
+	os.Exit(2)
+}
 
-	for _, user := range system.Users {
-		log.Printf("after transcation, %s has %d money", user.Name, user.Cash)
+func main() {
+	if len(os.Args) < 2 {
+		usage()
 	}
-
-	if err := system.UndoTranscation(2); err != nil {
-		log.Printf("undo transcation failed %v", err)
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
 	}
-
-	for _, user := range system.Users {
-		log.Printf("after undo transcation, %s has %d money", user.Name, user.Cash)
+	if err := command(os.Args[2:], os.Stdout); err != nil {
+		log.Fatalf("%s failed %v", os.Args[1], err)
 	}
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PurgeBefore discards items with LSN before lsn, but keeps every item of a
+// transcation which is not commited or aborted yet, or which ends at or after
+// lsn. Items kept are copied with their LSNs to a new file, which replaces the
+// log atomically: it is synced, then renamed over the log file, or becomes the
+// only segment listed by the manifest of a segmented log. Offsets of items
+// change, cursors taken before are no longer valid. Items written before
+// version 4 have no LSN, they are discarded unless their transcation is kept.
+func (l *UndoLog) PurgeBefore(lsn int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	return l.purgeBefore(lsn)
+}
+
+// PurgeBeforeTranscation discards items before the first item of
+// transcationID, as PurgeBefore does.
+func (l *UndoLog) PurgeBeforeTranscation(transcationID int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	entries, ok := l.index[transcationID]
+	if !ok {
+		return ErrUnknownTranscation
+	}
+	item, err := l.readAt(entries[len(entries)-1].Write)
+	if err != nil {
+		return err
+	}
+	return l.purgeBefore(item.lsn)
+}
+
+func (l *UndoLog) purgeBefore(lsn int64) error {
+	// LSN of the commit or abort item of every transcation which ends
+	ended := make(map[int]int64)
+	for offset := l.firstItemOffset(); offset < l.writeOffset; {
+		item, err := l.readAt(offset)
+		if err != nil {
+			return err
+		}
+		if item.Cmd == commit || item.Cmd == abort {
+			ended[item.TranscationID] = item.lsn
+		}
+		offset = item.NextOffset()
+	}
+	keep := func(item *UndoItem) bool {
+		if item.lsn >= lsn {
+			return true
+		}
+		if item.Cmd == checkpoint {
+			return false
+		}
+		end, ok := ended[item.TranscationID]
+		return !ok || end >= lsn
+	}
+
+	path := l.fileName
+	if len(l.segments) > 1 || !l.isBaseFile(l.segments[0].path) {
+		path = fmt.Sprintf("%s.%06d", l.fileName, l.segmentSeq(l.active().path)+1)
+	}
+	if err := l.copyItems(path, keep); err != nil {
+		return err
+	}
+	return l.replaceSegments(path)
+}
+
+// copyItems writes the items keep tells to a new log file at path, through a
+// temp file which is synced then renamed.
+func (l *UndoLog) copyItems(path string, keep func(*UndoItem) bool) error {
+	tmpName := path + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, l.fileMode())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	header := newFileHeader(0)
+	header.NextLSN = l.nextLSN
+	w := bufio.NewWriter(f)
+	offset, prev := header.NextItemOffset, int64(-1)
+	if _, err = w.Write(make([]byte, offset)); err != nil { // header goes last
+		f.Close()
+		return err
+	}
+	for from := l.firstItemOffset(); from < l.writeOffset; {
+		item, err := l.readAt(from)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		from = item.NextOffset()
+		if !keep(item) {
+			continue
+		}
+		length, err := item.ToBinary(w, header.Version, offset, prev)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		prev = offset
+		offset += length
+	}
+	header.EndingItemOffset = prev
+	header.Size = offset
+	var buf bytes.Buffer
+	if _, err = header.ToBinary(&buf, header.Version, 0, 0); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = f.WriteAt(buf.Bytes(), 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// replaceSegments makes the file at path the only segment of log, then
+// removes the others. Index and pending items are built again for the new
+// offsets.
+func (l *UndoLog) replaceSegments(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, l.fileMode())
+	if err != nil {
+		return err
+	}
+	header, err := l.readSegmentHeader(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	old := l.segments
+	l.segments = []*segment{{path: path, file: file, header: header}}
+	l.file = file
+	l.header = header
+	l.w.Reset(file)
+	l.writeOffset = header.Size
+	l.readOffset = header.EndingItemOffset
+	if err = l.writeManifest(); err != nil {
+		return err
+	}
+	for _, s := range old {
+		s.file.Close()
+		if s.path != path {
+			os.Remove(s.path)
+		}
+	}
+	l.sync.truncated(l.file, l.writeOffset)
+
+	pending := make(map[int]bool, len(l.pending))
+	for _, p := range l.pending {
+		pending[p.item.TranscationID] = true
+	}
+	l.dropIndexFile()
+	l.index = make(txIndex)
+	if err = l.buildIndex(l.firstItemOffset()); err != nil {
+		return err
+	}
+	// pending items are those found on open, not transcations in flight
+	kept := l.pending[:0]
+	for _, p := range l.pending {
+		if pending[p.item.TranscationID] {
+			kept = append(kept, p)
+		}
+	}
+	l.pending = kept
+	return nil
+}
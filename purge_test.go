@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPurgeBefore(t *testing.T) {
+	for _, opts := range []Options{{}, {SegmentSize: 200}} {
+		removeLog("./purge.bin")
+		log := NewUndoLog("./purge.bin", opts)
+		// 1 is open across the cut, 2 is commited before it, 3 ends after it
+		log.Write(&UndoItem{Cmd: begin, TranscationID: 1})
+		log.Write(&UndoItem{Cmd: write, TranscationID: 2, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10})
+		log.Write(&UndoItem{Cmd: commit, TranscationID: 2})
+		log.Write(&UndoItem{Cmd: write, TranscationID: 3, FromID: 2, FromCash: 10, ToID: 3, ToCash: 0, Cash: 5})
+		for i := 4; i <= 10; i++ {
+			log.Write(&UndoItem{Cmd: write, TranscationID: i, FromID: 1, FromCash: 90, ToID: 2, ToCash: 10, Cash: 1})
+			log.Write(&UndoItem{Cmd: commit, TranscationID: i})
+		}
+		cut := &UndoItem{Cmd: write, TranscationID: 11, FromID: 1, FromCash: 90, ToID: 2, ToCash: 10, Cash: 1}
+		log.Write(cut)
+		log.Write(&UndoItem{Cmd: commit, TranscationID: 3})
+		log.Write(&UndoItem{Cmd: commit, TranscationID: 11})
+		next := log.NextLSN()
+
+		if err := log.PurgeBefore(cut.LSN()); err != nil {
+			t.Fatal(err)
+		}
+		for id, want := range map[int]bool{1: true, 2: false, 3: true, 4: false, 10: false, 11: true} {
+			if _, ok := log.Lookup(id); ok != want {
+				t.Errorf("%v: transcation %d is kept %v, want %v", opts, id, ok, want)
+			}
+		}
+		if item, err := log.Cursor().SeekLSN(cut.LSN()); err != nil || item.TranscationID != 11 {
+			t.Errorf("%v: item at lsn %d is %v, %v", opts, cut.LSN(), item, err)
+		}
+		if log.NextLSN() != next {
+			t.Errorf("%v: next lsn is %d after purge, want %d", opts, log.NextLSN(), next)
+		}
+		if files, _ := filepath.Glob("./purge.bin*.tmp"); len(files) != 0 {
+			t.Errorf("%v: temp files are left, %v", opts, files)
+		}
+		log.Write(&UndoItem{Cmd: commit, TranscationID: 1})
+		log.Close()
+
+		log = NewUndoLog("./purge.bin", opts)
+		if len(log.Pending()) != 0 {
+			t.Errorf("%v: pending after reopen is %v", opts, log.Pending())
+		}
+		items, err := log.Items(3)
+		if err != nil || len(items) != 2 || items[1].Cmd != commit {
+			t.Errorf("%v: items of 3 are %v, %v", opts, items, err)
+		}
+		if log.NextLSN() != next+1 {
+			t.Errorf("%v: next lsn is %d after reopen, want %d", opts, log.NextLSN(), next+1)
+		}
+		log.Close()
+	}
+	removeLog("./purge.bin")
+}
+
+func TestGCInterval(t *testing.T) {
+	removeLog("./gc.bin")
+	os.Remove("./gc.users")
+	defer removeLog("./gc.bin")
+	defer os.Remove("./gc.users")
+	s, err := NewSystemWithOptions(SystemOptions{LogPath: "./gc.bin", SnapshotPath: "./gc.users", GCInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddUser(&User{1, "u1", 10})
+	s.AddUser(&User{2, "u2", 10})
+	// 1 is left open, as if it is still in flight
+	s.undoLog.Write(&UndoItem{Cmd: begin, TranscationID: 1})
+	for i := 2; i <= 21; i++ {
+		if err := s.DoTransaction(&Transcation{i, 1 + i%2, 2 - i%2, 1}); err != nil {
+			t.Fatal(err)
+		}
+		if i%5 == 0 {
+			if err := s.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, ok := s.undoLog.Lookup(19); !ok {
+			break
+		}
+	}
+	if _, ok := s.undoLog.Lookup(19); ok {
+		t.Error("items before checkpoint are not purged")
+	}
+	if _, ok := s.undoLog.Lookup(1); !ok {
+		t.Error("items of an open transcation are purged")
+	}
+	if _, ok := s.undoLog.Lookup(21); !ok {
+		t.Error("items after checkpoint are purged")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import "fmt"
+
+// Recover rebuilds users from the snapshot loaded on start and the undo log,
+// in three passes:
+//
+// analysis walks the log from the last checkpoint, or from the beginning if
+// there is none, and finds the transcations which are not commited or aborted.
+// redo applies every change after the checkpoint in log order, except those of
+// aborted transcations, which their rollback undid in memory only.
+// undo rolls back the changes of transcations found by analysis in reverse
+// order, and writes an abort item for each of them.
+//
+// Users must be the ones loaded from the snapshot, Recover is called instead of
+// RollbackPending, before any transfer or AddUser. If a change is of a user
+// missing from the snapshot, ErrUnknownUser is returned and no user is changed.
+func (s *System) Recover() error {
+	s.lockAll()
+	defer s.unlockAll()
+	if s.snapshotPath == "" {
+		return ErrNoSnapshot
+	}
+
+	changes, losers, err := s.analysis()
+	if err != nil {
+		return err
+	}
+	for _, item := range changes {
+		for _, id := range []int{item.FromID, item.ToID} {
+			if _, ok := s.Users[id]; !ok {
+				return fmt.Errorf("%w: %d", ErrUnknownUser, id)
+			}
+		}
+	}
+	for _, item := range changes {
+		s.redo(item)
+	}
+	open := make(map[int]bool, len(losers))
+	for _, id := range losers {
+		open[id] = true
+	}
+	for i := len(changes) - 1; i >= 0; i-- {
+		if open[changes[i].TranscationID] {
+			s.undo(changes[i])
+		}
+	}
+	for i := len(losers) - 1; i >= 0; i-- {
+		if err := s.abortUndoLog(losers[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// analysis returns write and delta items after the last checkpoint, but for
+// those of aborted transcations, and transcations left open, in the order they
+// began
+func (s *System) analysis() ([]*UndoItem, []int, error) {
+	c := s.undoLog.Cursor()
+	item, err := c.SeekEnd()
+	for err == nil && item != nil && item.Cmd != checkpoint {
+		item, err = c.Prev()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if item != nil {
+		item, err = c.Next()
+	} else {
+		item, err = c.SeekStart()
+	}
+
+	var changes []*UndoItem
+	var began []int
+	open := make(map[int]bool)
+	made := make(map[int][]int) // changes of open transcations
+	for ; err == nil && item != nil; item, err = c.Next() {
+		switch {
+		case isChange(item.Cmd):
+			made[item.TranscationID] = append(made[item.TranscationID], len(changes))
+			changes = append(changes, item)
+			fallthrough
+		case item.Cmd == begin:
+			if !open[item.TranscationID] {
+				open[item.TranscationID] = true
+				began = append(began, item.TranscationID)
+			}
+		case item.Cmd == commit || item.Cmd == abort:
+			if item.Cmd == abort {
+				for _, i := range made[item.TranscationID] {
+					changes[i] = nil
+				}
+			}
+			delete(made, item.TranscationID)
+			delete(open, item.TranscationID)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	kept := changes[:0]
+	for _, change := range changes {
+		if change != nil {
+			kept = append(kept, change)
+		}
+	}
+	changes = kept
+	var losers []int
+	for _, id := range began {
+		if open[id] {
+			losers = append(losers, id)
+			delete(open, id) // an id may begin again after it ends
+		}
+	}
+	return changes, losers, nil
+}
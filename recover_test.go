@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	removeLog("./recover.bin")
+	os.Remove("./recover.users")
+	defer removeLog("./recover.bin")
+	defer os.Remove("./recover.users")
+	opts := SystemOptions{LogPath: "./recover.bin", SnapshotPath: "./recover.users"}
+
+	s, _ := NewSystemWithOptions(opts)
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*User{{1, "u1", 10}, {2, "u2", 10}, {3, "u3", 10}} {
+		s.AddUser(u)
+	}
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	s.DoTransaction(&Transcation{1, 1, 2, 5})
+	tx, _ := s.Begin(2)
+	tx.Write(2, 3, 8)
+	tx.Commit()
+	tx, _ = s.Begin(3)
+	tx.Write(3, 1, 4)
+	// crash, the snapshot only has the balances at checkpoint
+	s.undoLog.file.Close()
+
+	s, err := NewSystemWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Users[1].Cash != 10 || s.Users[2].Cash != 10 || s.Users[3].Cash != 10 {
+		t.Fatalf("snapshot loads %v %v %v", s.Users[1], s.Users[2], s.Users[3])
+	}
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Users[1].Cash != 5 || s.Users[2].Cash != 7 || s.Users[3].Cash != 18 {
+		t.Errorf("recover gives %d %d %d", s.Users[1].Cash, s.Users[2].Cash, s.Users[3].Cash)
+	}
+	if aborted, _ := s.Aborted(); len(aborted) != 1 || aborted[0].TranscationID != 3 {
+		t.Errorf("aborted transcations are %v", aborted)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ = NewSystemWithOptions(opts)
+	defer s.Close()
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Users[1].Cash != 5 || s.Users[2].Cash != 7 || s.Users[3].Cash != 18 {
+		t.Errorf("recover after close gives %d %d %d", s.Users[1].Cash, s.Users[2].Cash, s.Users[3].Cash)
+	}
+}
+
+func TestRecoverRollback(t *testing.T) {
+	defer removeLog("./recover.bin")
+	defer os.Remove("./recover.users")
+	for _, logical := range []bool{false, true} {
+		removeLog("./recover.bin")
+		os.Remove("./recover.users")
+		opts := SystemOptions{LogPath: "./recover.bin", SnapshotPath: "./recover.users", LogicalUndo: logical}
+
+		s, _ := NewSystemWithOptions(opts)
+		s.Recover()
+		s.AddUser(&User{1, "u1", 10})
+		s.AddUser(&User{2, "u2", 10})
+		if err := s.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		tx, _ := s.Begin(1)
+		tx.Write(1, 2, 5)
+		tx.Rollback()
+
+		// crash after the rollback, then in a transcation which recover rolls
+		// back and logs an abort for, then once more after that recover
+		for crash := 1; crash <= 3; crash++ {
+			s.undoLog.file.Close()
+			s, _ = NewSystemWithOptions(opts)
+			if err := s.Recover(); err != nil {
+				t.Fatal(err)
+			}
+			if s.Users[1].Cash != 10 || s.Users[2].Cash != 10 {
+				t.Errorf("logical %v: recover after crash %d gives %d %d", logical, crash, s.Users[1].Cash, s.Users[2].Cash)
+			}
+			if crash == 1 {
+				tx, _ = s.Begin(2)
+				tx.Write(2, 1, 3)
+			}
+		}
+		s.undoLog.file.Close()
+	}
+}
+
+func TestRecoverAddUser(t *testing.T) {
+	removeLog("./recover.bin")
+	os.Remove("./recover.users")
+	defer removeLog("./recover.bin")
+	defer os.Remove("./recover.users")
+	opts := SystemOptions{LogPath: "./recover.bin", SnapshotPath: "./recover.users"}
+
+	s, _ := NewSystemWithOptions(opts)
+	s.Recover()
+	s.AddUser(&User{1, "u1", 10})
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUser(&User{2, "u2", 0}); err != nil {
+		t.Fatal(err)
+	}
+	s.DoTransaction(&Transcation{1, 1, 2, 4})
+	// crash, user 2 is only saved by AddUser
+	s.undoLog.file.Close()
+
+	s, _ = NewSystemWithOptions(opts)
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := s.Users[2]; !ok || s.Users[1].Cash != 6 || u.Cash != 4 {
+		t.Errorf("recover gives %v %v", s.Users[1], u)
+	}
+
+	// a change of a user missing from the snapshot is reported
+	s.DoTransaction(&Transcation{2, 2, 1, 1})
+	s.undoLog.file.Close()
+	s, _ = NewSystemWithOptions(opts)
+	defer s.Close()
+	delete(s.Users, 2)
+	if err := s.Recover(); !errors.Is(err, ErrUnknownUser) || s.Users[1].Cash != 10 {
+		t.Errorf("recover without user 2 returns %v, gives %v", err, s.Users[1])
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// errReplayDiverged is returned by the replay subcommand when the log does not
+// match the balances replayed
+var errReplayDiverged = errors.New("log diverges from balances replayed")
+
+var errReplayNotLog = errors.New("not an undo log, no header")
+
+// Divergence is a value logged by an item which does not match the balance
+// replayed up to it
+type Divergence struct {
+	Offset        int64  // offset of the item in log
+	TranscationID int    // transcation of the item
+	UserID        int    // user whose balance diverges
+	Field         string // value of item: "from_cash", "to_cash", "from_after", "to_after", or "user" if the user does not exist
+	Logged        int    // value logged
+	Replayed      int    // balance replayed
+}
+
+func (d Divergence) String() string {
+	if d.Field == "user" {
+		return fmt.Sprintf("offset %d transcation %d: user %d does not exist", d.Offset, d.TranscationID, d.UserID)
+	}
+	return fmt.Sprintf("offset %d transcation %d: %s of user %d is %d, replayed %d",
+		d.Offset, d.TranscationID, d.Field, d.UserID, d.Logged, d.Replayed)
+}
+
+// replayChange is a change of a transcation waiting for its commit item
+type replayChange struct {
+	offset int64
+	item   *UndoItem
+}
+
+// Replay re-applies the transfers of every commited transcation read from r,
+// a log file, or its segment files one after another, in the order they are
+// commited. Transcations aborted or not commited are skipped, so is an item
+// cut short by the end of r. Only balances of users change, nothing is logged.
+// Before-images of write items, and after-images since version 4, are checked
+// against the balances replayed, differences are returned as divergences.
+func (s *System) Replay(r io.Reader) ([]Divergence, error) {
+	s.lockAll()
+	defer s.unlockAll()
+	br := bufio.NewReader(r)
+	var diverged []Divergence
+	changes := make(map[int][]replayChange)
+	var header *fileHeader
+	var offset int64
+	for {
+		magic, err := br.Peek(4)
+		if err == io.EOF {
+			return diverged, nil // end of log, or a torn item
+		}
+		if err != nil {
+			return diverged, err
+		}
+		if int(binary.LittleEndian.Uint32(magic)) == constMAGIC {
+			// header of the log, or of the next segment
+			header = &fileHeader{}
+			if _, err = header.FromBinary(br, 0); err != nil {
+				return diverged, newCorruptionError(offset, err)
+			}
+			offset = header.NextItemOffset
+			continue
+		}
+		if header == nil {
+			return diverged, errReplayNotLog
+		}
+		item := &UndoItem{}
+		if _, err = item.FromBinary(br, header.Version); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return diverged, nil // torn item, it is never commited
+			}
+			return diverged, newCorruptionError(offset, err)
+		}
+		switch item.Cmd {
+		case write, delta:
+			changes[item.TranscationID] = append(changes[item.TranscationID], replayChange{offset, item})
+		case begin, abort:
+			delete(changes, item.TranscationID)
+		case commit:
+			for _, c := range changes[item.TranscationID] {
+				diverged = s.replay(c.offset, c.item, diverged)
+			}
+			delete(changes, item.TranscationID)
+		case savepoint, revert, checkpoint, rollbackTo:
+		default:
+			return diverged, newCorruptionError(offset, errUnknownItem)
+		}
+		offset += itemSize(item.Cmd, header.Version)
+	}
+}
+
+// replay applies a change to users and appends its divergences
+func (s *System) replay(offset int64, item *UndoItem, diverged []Divergence) []Divergence {
+	report := func(userID int, field string, logged, replayed int) {
+		diverged = append(diverged, Divergence{offset, item.TranscationID, userID, field, logged, replayed})
+	}
+	from, ok := s.Users[item.FromID]
+	if !ok {
+		report(item.FromID, "user", 0, 0)
+	}
+	to, ok := s.Users[item.ToID]
+	if !ok {
+		report(item.ToID, "user", 0, 0)
+	}
+	if from == nil || to == nil {
+		return diverged
+	}
+	if item.Cmd == delta {
+		from.Cash += item.FromCash
+		to.Cash += item.ToCash
+		return diverged
+	}
+	if item.FromCash != from.Cash {
+		report(from.ID, "from_cash", item.FromCash, from.Cash)
+	}
+	if item.ToCash != to.Cash {
+		report(to.ID, "to_cash", item.ToCash, to.Cash)
+	}
+	from.Cash -= item.Cash
+	to.Cash += item.Cash
+	if item.lsn == 0 {
+		return diverged // no after-images logged
+	}
+	if item.FromAfter != from.Cash {
+		report(from.ID, "from_after", item.FromAfter, from.Cash)
+	}
+	if item.ToAfter != to.Cash {
+		report(to.ID, "to_after", item.ToAfter, to.Cash)
+	}
+	return diverged
+}
+
+// runReplay is the replay subcommand: undo_log replay [-snapshot file] [file]
+// It replays a log, segments in order, against users of snapshot, then prints
+// the balances and divergences.
+func runReplay(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	snapshot := fs.String("snapshot", "", "snapshot of users when the log begins, no user if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := defaultLogPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	users := make(map[int]*User)
+	if *snapshot != "" {
+		saved, err := readSnapshot(*snapshot)
+		if err != nil {
+			return err
+		}
+		if saved == nil {
+			return fmt.Errorf("%s: %w", *snapshot, os.ErrNotExist)
+		}
+		users = saved
+	}
+	l := &UndoLog{fileName: path}
+	paths, err := l.readManifest()
+	if err != nil {
+		return err
+	}
+	var readers []io.Reader
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	s := &System{Users: users, locks: newLockManager()}
+	diverged, err := s.Replay(io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	ids := make([]int, 0, len(s.Users))
+	for id := range s.Users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fmt.Fprintf(w, "user %d %s has %d\n", id, s.Users[id].Name, s.Users[id].Cash)
+	}
+	for _, d := range diverged {
+		fmt.Fprintln(w, d)
+	}
+	if len(diverged) > 0 {
+		return errReplayDiverged
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	s, users := newTxSystem(t)
+	s.DoTransaction(&Transcation{1, 1, 2, 4})
+	tx, _ := s.Begin(2)
+	tx.Write(2, 3, 6)
+	tx.Savepoint("a")
+	tx.Write(3, 1, 9)
+	tx.RollbackTo("a")
+	tx.Commit()
+	tx, _ = s.Begin(3)
+	tx.Write(3, 1, 5)
+	tx.Rollback()
+	// 4 is never commited
+	s.writeUndoLog(&Transcation{4, 1, 3, 2}, users[0].Cash, users[2].Cash)
+	want := cashOf(users)
+	s.Close()
+
+	fresh := func() *System {
+		return &System{Users: map[int]*User{1: {1, "u1", 10}, 2: {2, "u2", 10}, 3: {3, "u3", 10}}, locks: newLockManager()}
+	}
+	replay := func(r *System) []Divergence {
+		f, err := os.Open("./undo.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		diverged, err := r.Replay(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return diverged
+	}
+	r := fresh()
+	if diverged := replay(r); len(diverged) != 0 {
+		t.Errorf("divergences replaying from start are %v", diverged)
+	}
+	if got := [3]int{r.Users[1].Cash, r.Users[2].Cash, r.Users[3].Cash}; got != want {
+		t.Errorf("balances replayed are %v, want %v", got, want)
+	}
+
+	// user 1 starts with less than what the log begins with, every item of it diverges
+	r = fresh()
+	r.Users[1].Cash = 8
+	diverged := replay(r)
+	if len(diverged) < 2 {
+		t.Fatalf("divergences are %v", diverged)
+	}
+	for _, d := range diverged {
+		if d.UserID != 1 || d.Logged-d.Replayed != 2 {
+			t.Errorf("divergence %v", d)
+		}
+	}
+	if d := diverged[0]; d.TranscationID != 1 || d.UserID != 1 || d.Field != "from_cash" || d.Logged != 10 || d.Replayed != 8 {
+		t.Errorf("first divergence is %v", d)
+	}
+	if d := diverged[1]; d.Field != "from_after" || d.Logged != 6 || d.Replayed != 4 {
+		t.Errorf("second divergence is %v", d)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// errScenarioFailed is returned by the run subcommand when a step or an
+// expected balance fails
+var errScenarioFailed = errors.New("scenario failed")
+
+// scenario is a regression test run against a System, read from a JSON or a
+// YAML file. Steps run in order, then final balances are checked.
+type scenario struct {
+	Name        string         `json:"name"`
+	Log         string         `json:"log"` // path of undo log, which must not exist; a temp file if empty
+	LogicalUndo bool           `json:"logical_undo"`
+	Users       []User         `json:"users"`
+	Steps       []scenarioStep `json:"steps"`
+	Expect      map[int]int    `json:"expect"` // cash of users by ID at the end
+}
+
+// scenarioStep is one of a transfer, an undo point or a crash point. A step
+// fails if it returns an error, or if it does not return ExpectError.
+type scenarioStep struct {
+	Transfer *Transcation `json:"transfer"`
+	Undo     *int         `json:"undo"` // UndoTranscation from this ID
+	// Crash stops the System as if the process died, after the write item
+	// of InFlight is logged and applied if any, then starts it again on the
+	// same log and users, and rolls back pending transcations.
+	Crash       bool         `json:"crash"`
+	InFlight    *Transcation `json:"in_flight"`
+	ExpectError string       `json:"expect_error"` // part of the error message expected
+}
+
+// loadScenario reads a scenario, files named *.yaml or *.yml are YAML, others
+// JSON. Unknown fields are errors.
+func loadScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		v, err := parseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	sc := &scenario{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(sc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return sc, nil
+}
+
+// run runs steps of scenario and checks the balances, it reports to w and
+// returns whether all passed. Error is returned if the System fails to run.
+func (sc *scenario) run(w io.Writer) (bool, error) {
+	logPath := sc.Log
+	if logPath == "" {
+		dir, err := os.MkdirTemp("", "scenario")
+		if err != nil {
+			return false, err
+		}
+		defer os.RemoveAll(dir)
+		logPath = filepath.Join(dir, "undo.bin")
+	}
+	opts := SystemOptions{LogPath: logPath, LogicalUndo: sc.LogicalUndo, Log: Options{Exclusive: true}}
+	s, err := NewSystemWithOptions(opts)
+	if err != nil {
+		return false, err
+	}
+	opts.Log.Exclusive = false
+	defer func() { s.Close() }()
+	for i := range sc.Users {
+		u := sc.Users[i]
+		if err := s.AddUser(&u); err != nil {
+			return false, err
+		}
+	}
+
+	passed := true
+	for i, step := range sc.Steps {
+		name, err := sc.runStep(&s, opts, step)
+		if name == "" {
+			return false, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		result := "ok"
+		switch {
+		case step.ExpectError == "" && err != nil:
+			result = fmt.Sprintf("FAIL: %v", err)
+		case step.ExpectError != "" && err == nil:
+			result = fmt.Sprintf("FAIL: no error, want %q", step.ExpectError)
+		case step.ExpectError != "" && !strings.Contains(err.Error(), step.ExpectError):
+			result = fmt.Sprintf("FAIL: %v, want %q", err, step.ExpectError)
+		case err != nil:
+			result = fmt.Sprintf("ok: %v", err)
+		}
+		passed = passed && strings.HasPrefix(result, "ok")
+		fmt.Fprintf(w, "step %d %s: %s\n", i+1, name, result)
+	}
+
+	ids := make([]int, 0, len(sc.Expect))
+	for id := range sc.Expect {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		want := sc.Expect[id]
+		user, ok := s.Users[id]
+		switch {
+		case !ok:
+			fmt.Fprintf(w, "user %d: FAIL: does not exist, want %d\n", id, want)
+			passed = false
+		case user.Cash != want:
+			fmt.Fprintf(w, "user %d: FAIL: has %d, want %d\n", id, user.Cash, want)
+			passed = false
+		default:
+			fmt.Fprintf(w, "user %d: ok: has %d\n", id, user.Cash)
+		}
+	}
+	return passed, nil
+}
+
+// runStep runs step against *s, a crash replaces *s. It returns the name of
+// step, or "" if the step is not valid or the System fails to restart.
+func (sc *scenario) runStep(s **System, opts SystemOptions, step scenarioStep) (string, error) {
+	switch {
+	case step.Transfer != nil:
+		t := *step.Transfer // a copy, System keeps it in history
+		return fmt.Sprintf("transfer %d", t.TranscationID), (*s).DoTransaction(&t)
+	case step.Undo != nil:
+		return fmt.Sprintf("undo %d", *step.Undo), (*s).UndoTranscation(*step.Undo)
+	case step.Crash:
+		name := "crash"
+		if t := step.InFlight; t != nil {
+			name = fmt.Sprintf("crash in transfer %d", t.TranscationID)
+			if err := (*s).crashIn(t); err != nil {
+				return name, err
+			}
+		}
+		// users keep what they have, as if they were stored apart from the log
+		users := (*s).Users
+		(*s).Close()
+		restarted, err := NewSystemWithOptions(opts)
+		if err != nil {
+			return "", err
+		}
+		restarted.Users = users
+		*s = restarted
+		return name, restarted.RollbackPending()
+	}
+	return "", errors.New("transfer, undo or crash expected")
+}
+
+// crashIn logs and applies transfer t as DoTransaction does, but stops before
+// its commit item
+func (s *System) crashIn(t *Transcation) error {
+	from, to, err := s.validate(t)
+	if err != nil {
+		return err
+	}
+	if from.Cash < t.Cash {
+		return fmt.Errorf("%w: %s with %d transfering %d", ErrInsufficientFunds, from.Name, from.Cash, t.Cash)
+	}
+	if err = s.writeUndoLog(t, from.Cash, to.Cash); err != nil {
+		return err
+	}
+	from.Cash -= t.Cash
+	to.Cash += t.Cash
+	return nil
+}
+
+// runScenario is the run subcommand: undo_log run file...
+func runScenario(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("scenario file expected")
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	failed := 0
+	for _, path := range fs.Args() {
+		sc, err := loadScenario(path)
+		if err != nil {
+			return err
+		}
+		name := sc.Name
+		if name == "" {
+			name = path
+		}
+		fmt.Fprintf(w, "scenario %s\n", name)
+		passed, err := sc.run(w)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if passed {
+			fmt.Fprintf(w, "PASS %s\n", name)
+		} else {
+			fmt.Fprintf(w, "FAIL %s\n", name)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", errScenarioFailed, failed, fs.NArg())
+	}
+	return nil
+}
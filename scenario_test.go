@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const demoScenario = `{
+  "name": "demo",
+  "users": [{"id": 1, "name": "Tom", "cash": 10}, {"id": 2, "name": "Jerry", "cash": 10}, {"id": 3, "name": "Spike", "cash": 10}],
+  "steps": [
+    {"transfer": {"id": 1, "from": 1, "to": 2, "cash": 10}},
+    {"transfer": {"id": 2, "from": 2, "to": 3, "cash": 5}},
+    {"transfer": {"id": 3, "from": 3, "to": 1, "cash": 20}, "expect_error": "insufficient fund"},
+    {"transfer": {"id": 4, "from": 2, "to": 1, "cash": 10}},
+    {"undo": 2}
+  ],
+  "expect": {"1": 0, "2": 20, "3": 10}
+}`
+
+const crashScenario = `# a transfer in flight is rolled back on restart
+name: crash
+users:
+  - {id: 1, name: Tom, cash: 10}
+  - id: 2
+    name: "Jerry"
+    cash: 10
+steps:
+- transfer: {id: 1, from: 1, to: 2, cash: 4}
+- crash: true
+  in_flight: {id: 2, from: 2, to: 1, cash: 14}
+- undo: 9
+  expect_error: does not exist
+expect:
+  1: 6
+  2: 13 # wrong on purpose
+`
+
+func TestScenario(t *testing.T) {
+	os.WriteFile("./demo.json", []byte(demoScenario), 0640)
+	os.WriteFile("./crash.yaml", []byte(crashScenario), 0640)
+	defer os.Remove("./demo.json")
+	defer os.Remove("./crash.yaml")
+
+	var out bytes.Buffer
+	if err := runScenario([]string{"./demo.json"}, &out); err != nil {
+		t.Fatalf("demo scenario returns %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "step 3 transfer 3: ok: insufficient fund") || !strings.Contains(out.String(), "PASS demo") {
+		t.Errorf("demo scenario reports\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runScenario([]string{"./crash.yaml"}, &out); !errors.Is(err, errScenarioFailed) {
+		t.Fatalf("crash scenario returns %v\n%s", err, out.String())
+	}
+	for _, want := range []string{"step 2 crash in transfer 2: ok", "step 3 undo 9: ok", "user 1: ok: has 6", "user 2: FAIL: has 14, want 13", "FAIL crash"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("crash scenario does not report %q\n%s", want, out.String())
+		}
+	}
+
+	os.WriteFile("./typo.json", []byte(`{"users": [], "step": []}`), 0640)
+	os.WriteFile("./typo.yml", []byte("users: []\nstep: []\n"), 0640)
+	defer os.Remove("./typo.json")
+	defer os.Remove("./typo.yml")
+	for _, path := range []string{"./typo.json", "./typo.yml"} {
+		if err := runScenario([]string{path}, &out); err == nil || !strings.Contains(err.Error(), `unknown field "step"`) {
+			t.Errorf("%s with unknown field returns %v", path, err)
+		}
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	v, err := parseYAML([]byte(`---
+a: 1
+b:
+  - x
+  - 'it''s' # comment
+  -
+    c: [1, "#2", "*3"]
+d:
+- {e: true, f: null}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"a": int64(1),
+		"b": []interface{}{"x", "it's", map[string]interface{}{"c": []interface{}{int64(1), "#2", "*3"}}},
+		"d": []interface{}{map[string]interface{}{"e": true, "f": nil}},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("parsed %#v", v)
+	}
+	if _, err := parseYAML([]byte("a: 1\n  b: 2\n")); err == nil {
+		t.Error("bad indent is parsed")
+	}
+
+	for _, unsupported := range []string{
+		"a: &x 1\nb: *x\n",
+		"- *x\n",
+		"&x a: 1\n",
+		"a: {b: *x}\n",
+		"a: !!str 1\n",
+		"a: |\n  line\n",
+		"a: >-\n  line\n",
+		"%YAML 1.2\n---\na: 1\n",
+		"a: 1\n---\na: 2\n",
+		"a: 1\n...\n",
+		"? a\n: 1\n",
+	} {
+		if _, err := parseYAML([]byte(unsupported)); !errors.Is(err, errYAMLUnsupported) {
+			t.Errorf("%q returns %v", unsupported, err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// segment is one file of an UndoLog. Offsets of items are global to the log,
+// an item at offset is stored at offset-base() of the segment file.
+type segment struct {
+	path   string
+	file   *os.File
+	header *fileHeader
+}
+
+// base returns the global offset of the beginning of segment file
+func (s *segment) base() int64 {
+	return s.header.NextItemOffset - headerSize(s.header.Version)
+}
+
+// size returns the size of segment file
+func (s *segment) size() (int64, error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (l *UndoLog) active() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+// segmentAt returns the segment which offset falls in, nil if offset is before all of them
+func (l *UndoLog) segmentAt(offset int64) *segment {
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		if offset >= l.segments[i].base() {
+			return l.segments[i]
+		}
+	}
+	return nil
+}
+
+// firstItemOffset returns offset of the first item still kept
+func (l *UndoLog) firstItemOffset() int64 {
+	return l.segments[0].header.NextItemOffset
+}
+
+func (l *UndoLog) manifestName() string {
+	return l.fileName + ".manifest"
+}
+
+func (l *UndoLog) isBaseFile(path string) bool {
+	return filepath.Clean(path) == filepath.Clean(l.fileName)
+}
+
+// readManifest returns paths of segments in order, a log without manifest is a single file
+func (l *UndoLog) readManifest() ([]string, error) {
+	data, err := os.ReadFile(l.manifestName())
+	if os.IsNotExist(err) {
+		return []string{l.fileName}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(l.fileName)
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, filepath.Join(dir, line))
+		}
+	}
+	if len(paths) == 0 {
+		return []string{l.fileName}, nil
+	}
+	return paths, nil
+}
+
+// writeManifest replaces manifest with the current segments through a temp file,
+// synced then renamed, and the directory is synced, so that segments it drops
+// can be removed. No manifest is needed if the log is a single file.
+// manifest: name of a segment file per line, in order
+func (l *UndoLog) writeManifest() error {
+	if len(l.segments) == 1 && l.isBaseFile(l.segments[0].path) {
+		if err := os.Remove(l.manifestName()); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		return syncDir(filepath.Dir(l.manifestName()))
+	}
+	var buf bytes.Buffer
+	for _, s := range l.segments {
+		fmt.Fprintln(&buf, filepath.Base(s.path))
+	}
+	tmpName := l.manifestName() + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, l.fileMode())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, l.manifestName()); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(l.manifestName()))
+}
+
+// segmentSeq returns the number of a segment file, the base file is 0
+func (l *UndoLog) segmentSeq(path string) int {
+	seq, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), filepath.Base(l.fileName)+"."))
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+// isFull tells if a new segment should be started before next item
+func (l *UndoLog) isFull() bool {
+	if l.opts.SegmentSize <= 0 || l.readOffset < l.header.NextItemOffset {
+		return false // no limit, or active segment has no item yet
+	}
+	return l.writeOffset-l.active().base() >= l.opts.SegmentSize
+}
+
+// rotate closes active segment and starts a new one, then applies retention policy
+func (l *UndoLog) rotate() error {
+	if err := l.writeHeader(l.header); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil { // syncer only follows the active segment
+		return err
+	}
+	path := fmt.Sprintf("%s.%06d", l.fileName, l.segmentSeq(l.active().path)+1)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, l.fileMode())
+	if err != nil {
+		return err
+	}
+	s := &segment{path: path, file: file, header: newFileHeader(l.writeOffset)}
+	l.segments = append(l.segments, s)
+	l.file = file
+	l.header = s.header
+	l.w.Reset(file)
+	l.writeOffset = l.header.NextItemOffset
+	if err = l.writeHeader(l.header); err != nil {
+		return err
+	}
+	if err = l.writeManifest(); err != nil {
+		return err
+	}
+	return l.retain()
+}
+
+// retain deletes the oldest segments beyond Options.RetainSegments, once every
+// transcation written in them is commited.
+func (l *UndoLog) retain() error {
+	if l.opts.RetainSegments <= 0 {
+		return nil
+	}
+	return l.dropSegments(len(l.segments) - l.opts.RetainSegments)
+}
+
+// dropSegments deletes up to n oldest segments, it stops at the first one with
+// a transcation not commited. The active segment is never deleted.
+func (l *UndoLog) dropSegments(n int) error {
+	var dropped []*segment
+	for ; n > 0 && len(l.segments) > 1; n-- {
+		end := l.segments[1].base()
+		if l.index.hasUncommited(l.segments[0].base(), end) {
+			break
+		}
+		dropped = append(dropped, l.segments[0])
+		l.segments = l.segments[1:]
+		l.index.dropBefore(end)
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	// manifest goes first, so that it never lists a deleted file
+	if err := l.writeManifest(); err != nil {
+		return err
+	}
+	for _, s := range dropped {
+		s.file.Close()
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropActive removes active segment, which has no item left, and makes the
+// previous one active again.
+func (l *UndoLog) dropActive() error {
+	s := l.active()
+	l.segments = l.segments[:len(l.segments)-1]
+	prev := l.active()
+	l.file = prev.file
+	l.header = prev.header
+	l.w.Reset(l.file)
+	if err := l.writeManifest(); err != nil {
+		return err
+	}
+	s.file.Close()
+	return os.Remove(s.path)
+}
+
+// openSegments opens every segment file listed by manifest. Headers of all but
+// the active segment are read, the active one is checked by Open.
+func (l *UndoLog) openSegments() error {
+	paths, err := l.readManifest()
+	if err != nil {
+		return err
+	}
+	flag := os.O_RDWR | os.O_CREATE
+	if l.opts.Exclusive {
+		if len(paths) > 1 || !l.isBaseFile(paths[0]) {
+			return os.ErrExist // manifest of a segmented log exists
+		}
+		flag |= os.O_EXCL
+	}
+	l.segments = make([]*segment, 0, len(paths))
+	for _, path := range paths {
+		file, err := os.OpenFile(path, flag, l.fileMode())
+		if err != nil {
+			return err
+		}
+		l.segments = append(l.segments, &segment{path: path, file: file})
+	}
+	l.file = l.active().file
+	l.w = bufio.NewWriter(l.file)
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if s.header, err = l.readSegmentHeader(s.file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeSegments closes files of all segments
+func (l *UndoLog) closeSegments() {
+	for _, s := range l.segments {
+		s.file.Close()
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// removeLog removes a log file with its segments, manifest and index
+func removeLog(name string) {
+	os.Remove(name)
+	files, _ := filepath.Glob(name + ".*")
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+func TestSegmentRotate(t *testing.T) {
+	removeLog("./test.bin")
+	defer removeLog("./test.bin")
+	opts := Options{SegmentSize: 200}
+	log := NewUndoLog("./test.bin", opts)
+	const count = 20
+	for i := 1; i <= count; i++ {
+		log.Write(&UndoItem{Cmd: write, TranscationID: i, FromID: i, FromCash: 100, ToID: i + 1, ToCash: 0, Cash: 10})
+		log.Write(&UndoItem{Cmd: commit, TranscationID: i})
+	}
+	if len(log.segments) < 3 {
+		t.Fatalf("log is not rotated, %d segments", len(log.segments))
+	}
+	for _, s := range log.segments[:len(log.segments)-1] {
+		if size, _ := s.size(); size > opts.SegmentSize+itemSize(write, constVERSION) {
+			t.Errorf("segment %s is over size limit, %d", s.path, size)
+		}
+	}
+	segments := len(log.segments)
+	log.Close()
+
+	if _, err := os.Stat("./test.bin.manifest"); err != nil {
+		t.Errorf("manifest is not written, %v", err)
+	}
+	log = NewUndoLog("./test.bin", opts)
+	if len(log.segments) != segments {
+		t.Errorf("%d segments after reopen, want %d", len(log.segments), segments)
+	}
+	if offset, ok := log.Lookup(1); !ok || offset != log.firstItemOffset() {
+		t.Errorf("lookup in first segment returns %d, %v", offset, ok)
+	}
+
+	// walk back through all segments
+	for i := count; i >= 1; i-- {
+		for _, cmd := range []cmdType{commit, write} {
+			item, err := log.Read()
+			if err != nil || item == nil {
+				t.Fatalf("read %d failed, %v", i, err)
+			}
+			if item.Cmd != cmd || item.TranscationID != i {
+				t.Errorf("item %d read does not match origin", i)
+			}
+			if err := log.Pop(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if item, _ := log.Read(); item != nil {
+		t.Error("log is not empty after popping all items")
+	}
+	if len(log.segments) != 1 {
+		t.Errorf("empty segments are not removed, %d left", len(log.segments))
+	}
+	log.Write(&UndoItem{Cmd: write, TranscationID: 99, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10})
+	log.Close()
+	if _, err := os.Stat("./test.bin.manifest"); !os.IsNotExist(err) {
+		t.Error("manifest is kept for a single file log")
+	}
+	log = NewUndoLog("./test.bin", opts)
+	defer log.Close()
+	if item, err := log.Read(); err != nil || item.TranscationID != 99 {
+		t.Errorf("read after shrinking to a single file failed, %v", err)
+	}
+}
+
+func TestSegmentRetention(t *testing.T) {
+	removeLog("./test.bin")
+	defer removeLog("./test.bin")
+	opts := Options{SegmentSize: 200, RetainSegments: 2}
+	log := NewUndoLog("./test.bin", opts)
+	defer log.Close()
+
+	// an uncommited transcation keeps its segment
+	log.Write(&UndoItem{Cmd: write, TranscationID: 1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10})
+	for i := 2; i <= 20; i++ {
+		log.Write(&UndoItem{Cmd: write, TranscationID: i, FromID: i, FromCash: 100, ToID: i + 1, ToCash: 0, Cash: 10})
+		log.Write(&UndoItem{Cmd: commit, TranscationID: i})
+	}
+	if _, err := os.Stat("./test.bin"); err != nil {
+		t.Error("segment with uncommited transcation is deleted")
+	}
+	log.Write(&UndoItem{Cmd: commit, TranscationID: 1})
+	for i := 21; i <= 30; i++ {
+		log.Write(&UndoItem{Cmd: write, TranscationID: i, FromID: i, FromCash: 100, ToID: i + 1, ToCash: 0, Cash: 10})
+		log.Write(&UndoItem{Cmd: commit, TranscationID: i})
+	}
+	if len(log.segments) > opts.RetainSegments {
+		t.Errorf("%d segments are kept", len(log.segments))
+	}
+	if _, err := os.Stat("./test.bin"); !os.IsNotExist(err) {
+		t.Error("old segment is not deleted")
+	}
+	if _, ok := log.Lookup(1); ok {
+		t.Error("transcation in deleted segment is still indexed")
+	}
+
+	cursor := log.Cursor()
+	first, err := cursor.SeekStart()
+	if err != nil || first == nil {
+		t.Fatalf("seek start after retention failed, %v", err)
+	}
+	if item, err := cursor.Prev(); item != nil || err != nil {
+		t.Error("walk back into a deleted segment")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrDuplicateTranscation is returned by the server for a transcation id still in undo log, or being done
+var ErrDuplicateTranscation = errors.New("transcation id is already in use")
+
+// shutdownTimeout bounds how long serve waits for requests in flight on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// server serves a System over HTTP/JSON:
+//
+//	POST /users                   AddUser, body is a User
+//	GET  /users/{id}              balance of a user
+//	POST /transactions            DoTransaction, body is a Transcation
+//	GET  /transactions[?user=id]  history, of a user if set
+//	POST /transactions/{id}/undo  UndoTranscation
+type server struct {
+	s     *System
+	mu    sync.Mutex
+	doing map[int]bool // transcation ids being done
+}
+
+func newServer(s *System) http.Handler {
+	srv := &server{s: s, doing: make(map[int]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", methods{http.MethodPost: srv.addUser}.serve)
+	mux.HandleFunc("/users/", methods{http.MethodGet: srv.user}.serve)
+	mux.HandleFunc("/transactions", methods{http.MethodPost: srv.transfer, http.MethodGet: srv.history}.serve)
+	mux.HandleFunc("/transactions/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/undo") {
+			http.NotFound(w, r)
+			return
+		}
+		methods{http.MethodPost: srv.undo}.serve(w, r)
+	})
+	return mux
+}
+
+// methods routes a path by method, others get 405
+type methods map[string]http.HandlerFunc
+
+func (m methods) serve(w http.ResponseWriter, r *http.Request) {
+	if h, ok := m[r.Method]; ok {
+		h(w, r)
+		return
+	}
+	allowed := make([]string, 0, len(m))
+	for method := range m {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, apiError{r.Method + " is not allowed"})
+}
+
+func (srv *server) addUser(w http.ResponseWriter, r *http.Request) {
+	var u User
+	if !readJSON(w, r, &u) {
+		return
+	}
+	added := u // System keeps the pointer, reply with a copy
+	if err := srv.s.AddUser(&added); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, u)
+}
+
+func (srv *server) user(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	u, err := srv.s.User(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (srv *server) transfer(w http.ResponseWriter, r *http.Request) {
+	var t Transcation
+	if !readJSON(w, r, &t) {
+		return
+	}
+	if !srv.reserve(t.TranscationID) {
+		writeError(w, fmt.Errorf("%w: %d", ErrDuplicateTranscation, t.TranscationID))
+		return
+	}
+	defer srv.release(t.TranscationID)
+	done := t // System keeps the pointer in history, reply with a copy
+	if err := srv.s.DoTransaction(&done); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, t)
+}
+
+// reserve tells if transcation id is free, neither in undo log nor being done,
+// and keeps it until release
+func (srv *server) reserve(id int) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.s.undoLog.Lookup(id); ok || srv.doing[id] {
+		return false
+	}
+	srv.doing[id] = true
+	return true
+}
+
+func (srv *server) release(id int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.doing, id)
+}
+
+func (srv *server) history(w http.ResponseWriter, r *http.Request) {
+	history := srv.s.History()
+	if v := r.URL.Query().Get("user"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{"user is not a number"})
+			return
+		}
+		kept := history[:0]
+		for _, t := range history {
+			if t.FromID == id || t.ToID == id {
+				kept = append(kept, t)
+			}
+		}
+		history = kept
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func (srv *server) undo(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if err := srv.s.UndoTranscation(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiError is the body of a response to a failed request
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// statusOf returns the HTTP status of an error returned by System
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownUser), errors.Is(err, ErrUnknownTranscation):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDuplicateUser), errors.Is(err, ErrDuplicateTranscation):
+		return http.StatusConflict
+	case errors.Is(err, ErrInsufficientFunds):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrSelfTransfer), errors.Is(err, ErrNonPositiveAmount):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrLogClosed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusOf(err), apiError{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// readJSON decodes body of r into v, or replies 400 and returns false
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"bad request body: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+// pathID returns the id in /users/{id} or /transactions/{id}/undo, or replies
+// 404 if path is neither, 400 if id is not a number, and returns false
+func pathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 && !(len(parts) == 3 && parts[0] == "transactions") {
+		http.NotFound(w, r)
+		return 0, false
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"id is not a number"})
+		return 0, false
+	}
+	return id, true
+}
+
+// runServe is the serve subcommand: undo_log serve [-addr addr] [-log file] [-snapshot file] [-logical]
+// It stops on SIGINT or SIGTERM.
+func runServe(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	opts := SystemOptions{}
+	fs.StringVar(&opts.LogPath, "log", defaultLogPath, "path of undo log")
+	fs.StringVar(&opts.SnapshotPath, "snapshot", "", "snapshot of users, users only live in memory if empty")
+	fs.BoolVar(&opts.LogicalUndo, "logical", false, "log transfers as delta items")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, ln, opts, out)
+}
+
+// serve runs a System on ln until ctx is done, then shuts down: requests in
+// flight are finished, then System is closed. System is closed on every
+// return, so is ln. On start, users of the snapshot are recovered from the
+// log, or pending transcations are rolled back if there is no snapshot.
+func serve(ctx context.Context, ln net.Listener, opts SystemOptions, out io.Writer) (err error) {
+	s, err := NewSystemWithOptions(opts)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	defer func() {
+		if closeErr := s.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if opts.SnapshotPath != "" {
+		err = s.Recover()
+	} else {
+		err = s.RollbackPending()
+	}
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	srv := &http.Server{Handler: newServer(s), ReadHeaderTimeout: 10 * time.Second}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	fmt.Fprintf(out, "serving on %s\n", ln.Addr())
+	select {
+	case err = <-served:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
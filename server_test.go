@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	defer s.Close()
+	ts := httptest.NewServer(newServer(s))
+	defer ts.Close()
+
+	do := func(method, path, body string, want int) []byte {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want {
+			t.Errorf("%s %s returns %d %s, want %d", method, path, resp.StatusCode, data, want)
+		}
+		return data
+	}
+	do("POST", "/users", `{"id": 1, "name": "Tom", "cash": 10}`, http.StatusCreated)
+	do("POST", "/users", `{"id": 2, "name": "Jerry", "cash": 10}`, http.StatusCreated)
+	do("POST", "/users", `{"id": 2, "name": "Spike", "cash": 10}`, http.StatusConflict)
+	do("POST", "/users", `{"id": 3, "nickname": "Spike"}`, http.StatusBadRequest)
+
+	do("POST", "/transactions", `{"id": 1, "from": 1, "to": 2, "cash": 4}`, http.StatusCreated)
+	do("POST", "/transactions", `{"id": 1, "from": 1, "to": 2, "cash": 1}`, http.StatusConflict)
+	do("POST", "/transactions", `{"id": 2, "from": 1, "to": 2, "cash": 7}`, http.StatusUnprocessableEntity)
+	do("POST", "/transactions", `{"id": 2, "from": 1, "to": 9, "cash": 1}`, http.StatusNotFound)
+	do("POST", "/transactions", `{"id": 2, "from": 1, "to": 1, "cash": 1}`, http.StatusBadRequest)
+	do("POST", "/transactions", `{"id": 2, "from": 2, "to": 1, "cash": 2}`, http.StatusCreated)
+
+	var u User
+	json.Unmarshal(do("GET", "/users/1", "", http.StatusOK), &u)
+	if u != (User{1, "Tom", 8}) {
+		t.Errorf("user 1 is %v", u)
+	}
+	do("GET", "/users/9", "", http.StatusNotFound)
+	do("GET", "/users/x", "", http.StatusBadRequest)
+	do("GET", "/users/", "", http.StatusNotFound)
+	do("GET", "/users/1/2", "", http.StatusNotFound)
+
+	var history []Transcation
+	json.Unmarshal(do("GET", "/transactions?user=2", "", http.StatusOK), &history)
+	if len(history) != 2 || history[0] != (Transcation{1, 1, 2, 4}) || history[1] != (Transcation{2, 2, 1, 2}) {
+		t.Errorf("history is %v", history)
+	}
+
+	do("POST", "/transactions/2/undo", "", http.StatusNoContent)
+	do("POST", "/transactions/2/undo", "", http.StatusNotFound)
+	json.Unmarshal(do("GET", "/users/1", "", http.StatusOK), &u)
+	if u.Cash != 6 {
+		t.Errorf("user 1 has %d after undo", u.Cash)
+	}
+	history = nil
+	json.Unmarshal(do("GET", "/transactions", "", http.StatusOK), &history)
+	if len(history) != 1 || history[0] != (Transcation{1, 1, 2, 4}) {
+		t.Errorf("history after undo is %v", history)
+	}
+	do("DELETE", "/users/1", "", http.StatusMethodNotAllowed)
+}
+
+func TestServeShutdown(t *testing.T) {
+	removeLog("./serve.bin")
+	defer removeLog("./serve.bin")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, ln, SystemOptions{LogPath: "./serve.bin"}, io.Discard) }()
+
+	url := "http://" + ln.Addr().String()
+	if resp, err := http.Post(url+"/users", "application/json", bytes.NewBufferString(`{"id": 1, "cash": 10}`)); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+	http.Post(url+"/users", "application/json", bytes.NewBufferString(`{"id": 2, "cash": 10}`))
+	http.Post(url+"/transactions", "application/json", bytes.NewBufferString(`{"id": 1, "from": 1, "to": 2, "cash": 3}`))
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("serve returns %v", err)
+	}
+
+	// undo log is closed properly, or strict recovery refuses it
+	log, err := OpenUndoLog("./serve.bin", Options{Recovery: RecoverStrict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if _, ok := log.Lookup(1); !ok {
+		t.Error("transcation done before shutdown is not logged")
+	}
+}
+
+func TestServeRecover(t *testing.T) {
+	removeLog("./serve.bin")
+	os.Remove("./serve.users")
+	defer removeLog("./serve.bin")
+	defer os.Remove("./serve.users")
+	opts := SystemOptions{LogPath: "./serve.bin", SnapshotPath: "./serve.users"}
+
+	s, _ := NewSystemWithOptions(opts)
+	s.AddUser(&User{1, "Tom", 10})
+	s.AddUser(&User{2, "Jerry", 10})
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	s.DoTransaction(&Transcation{1, 1, 2, 4})
+	// crash, the snapshot only has the balances at checkpoint
+	s.undoLog.file.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, ln, opts, io.Discard) }()
+	url := "http://" + ln.Addr().String()
+	for id, want := range map[int]int{1: 6, 2: 14} {
+		resp, err := http.Get(url + "/users/" + strconv.Itoa(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var u User
+		json.NewDecoder(resp.Body).Decode(&u)
+		resp.Body.Close()
+		if u.Cash != want {
+			t.Errorf("user %d has %d after crash, want %d", id, u.Cash, want)
+		}
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("serve returns %v", err)
+	}
+
+	users, err := readSnapshot("./serve.users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users[1].Cash != 6 || users[2].Cash != 14 {
+		t.Errorf("snapshot has %d %d after shutdown", users[1].Cash, users[2].Cash)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var errSnapshotCorrupt = errors.New("snapshot file is corrupted")
+
+// ErrNoSnapshot is returned by Checkpoint when SystemOptions.SnapshotPath is not set
+var ErrNoSnapshot = errors.New("snapshot path is not set")
+
+// ErrPendingTranscation is returned by Checkpoint while transcations found on
+// open are not rolled back, see RollbackPending
+var ErrPendingTranscation = errors.New("pending transcations are not rolled back")
+
+const constSnapshotMAGIC int32 = 0x00736475 //UDS\0
+
+// snapshot file: magic:4|count:8|(id:4|cash:4|name length:4|name)*count|crc:4
+// users are ordered by id.
+func writeSnapshot(path string, users map[int]*User, mode os.FileMode) error {
+	tmpName := path + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	ids := make([]int, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	crc := crc32.New(crcTable)
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+	binary.Write(w, binary.LittleEndian, constSnapshotMAGIC)
+	binary.Write(w, binary.LittleEndian, int64(len(ids)))
+	for _, id := range ids {
+		u := users[id]
+		binary.Write(w, binary.LittleEndian, []int32{int32(u.ID), int32(u.Cash), int32(len(u.Name))})
+		w.WriteString(u.Name)
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = binary.Write(f, binary.LittleEndian, crc.Sum32()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readSnapshot returns users saved in snapshot file, nil if there is no such file
+func readSnapshot(path string) (map[int]*User, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	crc := crc32.New(crcTable)
+	r := io.TeeReader(bufio.NewReader(f), crc)
+	var magic int32
+	var count int64
+	binary.Read(r, binary.LittleEndian, &magic)
+	if err = binary.Read(r, binary.LittleEndian, &count); err != nil || magic != constSnapshotMAGIC || count < 0 {
+		return nil, errSnapshotCorrupt
+	}
+	users := make(map[int]*User)
+	for i := int64(0); i < count; i++ {
+		v := make([]int32, 3)
+		if err = binary.Read(r, binary.LittleEndian, v); err != nil || v[2] < 0 || v[2] > maxItemSize {
+			return nil, errSnapshotCorrupt
+		}
+		name := make([]byte, v[2])
+		if _, err = io.ReadFull(r, name); err != nil {
+			return nil, errSnapshotCorrupt
+		}
+		users[int(v[0])] = &User{int(v[0]), string(name), int(v[1])}
+	}
+	var stored uint32
+	sum := crc.Sum32()
+	if err = binary.Read(r, binary.LittleEndian, &stored); err != nil || stored != sum {
+		return nil, errSnapshotCorrupt
+	}
+	return users, nil
+}
+
+// Checkpoint saves users to the snapshot file, and once it is durable, writes a
+// checkpoint item to undo log: items before it are covered by the snapshot.
+// It waits for transcations in flight, and refuses while pending ones are not
+// rolled back.
+func (s *System) Checkpoint() error {
+	s.lockAll()
+	defer s.unlockAll()
+	return s.checkpoint()
+}
+
+func (s *System) checkpoint() error {
+	if s.snapshotPath == "" {
+		return ErrNoSnapshot
+	}
+	if len(s.undoLog.Pending()) > 0 {
+		return ErrPendingTranscation
+	}
+	if err := writeSnapshot(s.snapshotPath, s.Users, s.undoLog.fileMode()); err != nil {
+		return err
+	}
+	if err := s.undoLog.Write(&UndoItem{Cmd: checkpoint}); err != nil {
+		return err
+	}
+	return s.undoLog.WaitSync()
+}
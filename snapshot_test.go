@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	removeLog("./snap.bin")
+	os.Remove("./snap.users")
+	defer removeLog("./snap.bin")
+	defer os.Remove("./snap.users")
+	opts := SystemOptions{LogPath: "./snap.bin", SnapshotPath: "./snap.users", Log: Options{SegmentSize: 200}}
+
+	s, err := NewSystemWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddUser(&User{1, "u1", 10})
+	s.AddUser(&User{2, "u2", 10})
+	for i := 1; i <= 5; i++ {
+		s.DoTransaction(&Transcation{i, 1, 2, 1})
+	}
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	lsn, ok, err := s.undoLog.LastCheckpoint()
+	if item, _ := s.undoLog.Cursor().SeekLSN(lsn); !ok || err != nil || item.Cmd != checkpoint {
+		t.Errorf("last checkpoint is at LSN %d %v, %v", lsn, ok, err)
+	}
+	s.DoTransaction(&Transcation{6, 2, 1, 3})
+	if err := s.gcUndoLog(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.undoLog.Lookup(1); ok {
+		t.Error("items before checkpoint are kept")
+	}
+	if _, ok := s.undoLog.Lookup(6); !ok {
+		t.Error("items after checkpoint are dropped")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewSystemWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Users) != 2 || *s.Users[1] != (User{1, "u1", 8}) || *s.Users[2] != (User{2, "u2", 12}) {
+		t.Errorf("users loaded are %v %v", s.Users[1], s.Users[2])
+	}
+	if err := s.gcUndoLog(); err != nil {
+		t.Fatal(err)
+	}
+	if item, _ := s.undoLog.Read(); item != nil {
+		t.Errorf("log is not purged at checkpoint, last item %v", item)
+	}
+
+	// crash in a transfer, it is rolled back before a checkpoint
+	s.writeUndoLog(&Transcation{7, 1, 2, 8}, 8, 12)
+	s.undoLog.file.Close()
+	s, err = NewSystemWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Checkpoint(); err != ErrPendingTranscation {
+		t.Errorf("checkpoint with pending transcations returns %v", err)
+	}
+	if err := s.RollbackPending(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	defer os.Remove("./snap.users")
+	users := map[int]*User{1: {1, "u1", 10}, 2: {2, "", -3}}
+	if err := writeSnapshot("./snap.users", users, 0640); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readSnapshot("./snap.users")
+	if err != nil || len(loaded) != 2 || *loaded[1] != *users[1] || *loaded[2] != *users[2] {
+		t.Fatalf("snapshot loads %v, %v", loaded, err)
+	}
+	f, _ := os.OpenFile("./snap.users", os.O_RDWR, 0)
+	f.WriteAt([]byte{0xff}, 20)
+	f.Close()
+	if _, err := readSnapshot("./snap.users"); err != errSnapshotCorrupt {
+		t.Errorf("corrupted snapshot returns %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncMode decides when written items are synced to disk
+type SyncMode int
+
+const (
+	// SyncEveryWrite syncs after every item, the default
+	SyncEveryWrite SyncMode = iota
+	// SyncOnCommit syncs after commit, abort and checkpoint items only, write items may be lost with the OS
+	SyncOnCommit
+	// SyncInterval syncs in background every Options.SyncInterval
+	SyncInterval
+	// SyncGroupCommit leaves syncing to WaitSync, concurrent waiters share one sync
+	SyncGroupCommit
+)
+
+const defaultSyncInterval = 100 * time.Millisecond
+
+// syncer tracks how much of the log is written and how much is synced.
+// It has its own lock, so that waiters do not hold the caller's lock.
+type syncer struct {
+	mode    SyncMode
+	mu      sync.Mutex
+	cond    *sync.Cond
+	file    *os.File // file being written
+	written int64    // offset written to file
+	synced  int64    // offset synced to disk
+	syncing bool     // a waiter is syncing for all the others
+	err     error
+	stop    chan struct{}
+}
+
+func newSyncer(mode SyncMode, interval time.Duration) *syncer {
+	s := &syncer{mode: mode}
+	s.cond = sync.NewCond(&s.mu)
+	if mode == SyncInterval {
+		if interval <= 0 {
+			interval = defaultSyncInterval
+		}
+		s.stop = make(chan struct{})
+		go s.loop(interval)
+	}
+	return s
+}
+
+// wrote records an item written to file up to offset, and syncs it if mode requires
+func (s *syncer) wrote(file *os.File, offset int64, cmd cmdType) error {
+	s.mu.Lock()
+	s.file = file
+	s.written = offset
+	s.mu.Unlock()
+	if s.mode == SyncEveryWrite || (s.mode == SyncOnCommit && (cmd == commit || cmd == abort || cmd == checkpoint)) {
+		return s.wait()
+	}
+	return nil
+}
+
+// truncated records that file is truncated to offset
+func (s *syncer) truncated(file *os.File, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = file
+	s.written = offset
+	if s.synced > offset {
+		s.synced = offset
+	}
+}
+
+// wait blocks until everything written so far is synced. If no one is syncing,
+// caller syncs for every waiter, otherwise it waits for the running sync.
+func (s *syncer) wait() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target := s.written
+	for s.synced < target {
+		if s.err != nil {
+			return s.err
+		}
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+		s.syncing = true
+		written, file := s.written, s.file
+		s.mu.Unlock()
+		err := file.Sync()
+		s.mu.Lock()
+		s.syncing = false
+		if err != nil {
+			s.err = err
+		} else if written > s.synced {
+			s.synced = written
+		}
+		s.cond.Broadcast()
+	}
+	return nil
+}
+
+// syncedOffset returns offset synced to disk
+func (s *syncer) syncedOffset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.synced
+}
+
+func (s *syncer) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.wait()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close stops background sync and syncs what is left
+func (s *syncer) close() error {
+	if s.stop != nil {
+		close(s.stop)
+	}
+	if s.file == nil {
+		return nil
+	}
+	return s.wait()
+}
+
+// WaitSync blocks until every item written so far is synced to disk. Only
+// SyncGroupCommit needs it, call it without holding locks shared with other
+// writers, so that they can share the same sync.
+func (l *UndoLog) WaitSync() error {
+	if l.sync.mode != SyncGroupCommit {
+		return nil
+	}
+	return l.sync.wait()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSyncSystem returns a system over a fresh log synced in mode, with users 0 and 1
+func newSyncSystem(name string, mode SyncMode) *System {
+	removeLog(name)
+	s, _ := NewSystemWithOptions(SystemOptions{
+		LogPath: name,
+		Log:     Options{Sync: mode, SyncInterval: 10 * time.Millisecond},
+	})
+	s.AddUser(&User{0, "u0", 1 << 30})
+	s.AddUser(&User{1, "u1", 1 << 30})
+	return s
+}
+
+func TestSyncModes(t *testing.T) {
+	defer removeLog("./sync.bin")
+	for _, mode := range []SyncMode{SyncEveryWrite, SyncOnCommit, SyncInterval, SyncGroupCommit} {
+		s := newSyncSystem("./sync.bin", mode)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				if err := s.DoTransaction(&Transcation{id, id % 2, 1 - id%2, 1}); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		log := s.undoLog
+		if mode == SyncInterval {
+			for i := 0; i < 100 && log.sync.syncedOffset() < log.writeOffset; i++ {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		if synced := log.sync.syncedOffset(); synced != log.writeOffset {
+			t.Errorf("mode %d: synced %d of %d", mode, synced, log.writeOffset)
+		}
+		s.Close()
+	}
+}
+
+func BenchmarkSyncMode(b *testing.B) {
+	defer removeLog("./sync.bin")
+	modes := []struct {
+		name string
+		mode SyncMode
+	}{
+		{"EveryWrite", SyncEveryWrite},
+		{"OnCommit", SyncOnCommit},
+		{"Interval", SyncInterval},
+		{"GroupCommit", SyncGroupCommit},
+	}
+	for _, m := range modes {
+		b.Run(m.name, func(b *testing.B) {
+			s := newSyncSystem("./sync.bin", m.mode)
+			defer s.Close()
+			var id int64
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := int(atomic.AddInt64(&id, 1))
+					if err := s.DoTransaction(&Transcation{n, n % 2, 1 - n%2, 1}); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "tx/s")
+		})
+	}
+}
@@ -4,97 +4,276 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
+// ErrUnknownTranscation is returned when a transcation id is not found in undo log
+var ErrUnknownTranscation = errors.New("transcation id does not exist")
+
+// Errors of Revert
+var (
+	ErrNotCommited     = errors.New("transcation is not commited")
+	ErrAlreadyReverted = errors.New("transcation is already reverted")
+)
+
+// Errors of a rejected transfer, it is never logged.
+var (
+	ErrUnknownUser       = errors.New("user does not exist")
+	ErrInsufficientFunds = errors.New("insufficient fund")
+	ErrSelfTransfer      = errors.New("transfer to the same user")
+	ErrNonPositiveAmount = errors.New("transfer amount is not positive")
+)
+
+// ErrDuplicateUser is returned by AddUser when the user id is taken
+var ErrDuplicateUser = errors.New("user id is already exists")
+
 // User saves user's information
 type User struct {
-	ID   int
-	Name string
-	Cash int
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Cash int    `json:"cash"`
 }
 
 // Transcation record a transcation.
 type Transcation struct {
-	TranscationID int
-	FromID        int
-	ToID          int
-	Cash          int
+	TranscationID int `json:"id"`
+	FromID        int `json:"from"`
+	ToID          int `json:"to"`
+	Cash          int `json:"cash"`
 }
 
-// System keeps the user and transcation information
+// System keeps the user and transcation information.
+// Transfers hold the read lock and the locks of their users, so that transfers
+// between unrelated users run in parallel. A Tx holds the locks of its users
+// until it ends, and the read lock during each call only. Everything else
+// holds the write lock, once open Txs end, see lockAll.
 type System struct {
 	sync.RWMutex
 	Users        map[int]*User
 	Transcations []*Transcation
 	undoLog      *UndoLog
+	locks        *lockManager
+	history      sync.Mutex // guards Transcations during transfers
+	revertMu     sync.Mutex
+	reverting    map[int]bool // transcations a Revert runs for, guarded by revertMu
+	logical      bool         // SystemOptions.LogicalUndo
+	snapshotPath string
+	gcStop       chan struct{} // stops gcLoop, nil without SystemOptions.GCInterval
+	gcDone       chan struct{}
 }
 
-// NewSystem returns a System
-func NewSystem() *System {
-	return &System{
-		Users:        make(map[int]*User),
+// SystemOptions configures a System
+type SystemOptions struct {
+	LogPath string  // path of undo log, "./undo.bin" if empty
+	Log     Options // options of undo log
+	// LogicalUndo logs transfers as delta items, undo subtracts the changes
+	// instead of writing back before-images, so it keeps later updates made to
+	// the same users.
+	LogicalUndo bool
+	// SnapshotPath is the file users are saved to by Checkpoint and Close, and
+	// loaded from on start. Users only live in memory if it is empty.
+	SnapshotPath string
+	// GCInterval drops items older than the last checkpoint in background,
+	// every GCInterval. No background GC if it is zero.
+	GCInterval time.Duration
+}
+
+const defaultLogPath = "./undo.bin"
+
+// NewSystemWithOptions returns a System, or error if its undo log fails to open
+func NewSystemWithOptions(opts SystemOptions) (*System, error) {
+	if opts.LogPath == "" {
+		opts.LogPath = defaultLogPath
+	}
+	users := make(map[int]*User)
+	if opts.SnapshotPath != "" {
+		saved, err := readSnapshot(opts.SnapshotPath)
+		if err != nil {
+			return nil, err
+		}
+		if saved != nil {
+			users = saved
+		}
+	}
+	undoLog, err := OpenUndoLog(opts.LogPath, opts.Log)
+	if err != nil {
+		return nil, err
+	}
+	s := &System{
+		Users:        users,
 		Transcations: make([]*Transcation, 0, 10),
-		undoLog:      NewUndoLog("./undo.bin"),
+		undoLog:      undoLog,
+		locks:        newLockManager(),
+		reverting:    make(map[int]bool),
+		logical:      opts.LogicalUndo,
+		snapshotPath: opts.SnapshotPath,
+	}
+	if opts.GCInterval > 0 {
+		s.gcStop = make(chan struct{})
+		s.gcDone = make(chan struct{})
+		go s.gcLoop(opts.GCInterval)
 	}
+	return s, nil
 }
 
-// AddUser adds a new user to the system
-func (s *System) AddUser(u *User) error {
+// lockAll waits until no Tx is open and takes the write lock, Txs wait to
+// begin until unlockAll. A Tx must not be open by the caller, it would never end.
+func (s *System) lockAll() {
+	s.locks.exclude()
 	s.Lock()
-	defer s.Unlock()
+}
+
+func (s *System) unlockAll() {
+	s.Unlock()
+	s.locks.include()
+}
+
+// NewSystem returns a System logging to "./undo.bin", panics if it fails. See NewSystemWithOptions.
+func NewSystem() *System {
+	s, err := NewSystemWithOptions(SystemOptions{})
+	if err != nil {
+		panic("System open failed: " + err.Error())
+	}
+	return s
+}
+
+// AddUser adds a new user to the system, it waits for open Txs like other
+// System wide operations. Users are not logged, so with a snapshot AddUser
+// takes a checkpoint to save the user, and the user is not added if it fails.
+func (s *System) AddUser(u *User) error {
+	s.lockAll()
+	defer s.unlockAll()
 	if _, ok := s.Users[u.ID]; ok {
-		return errors.New("user id is already exists")
+		return fmt.Errorf("%w: %d", ErrDuplicateUser, u.ID)
 	}
 
 	s.Users[u.ID] = u
+	if s.snapshotPath != "" {
+		if err := s.checkpoint(); err != nil {
+			delete(s.Users, u.ID)
+			return err
+		}
+	}
 
 	return nil
 }
 
+// User returns a copy of user id, taken while no transfer changes it
+func (s *System) User(id int) (User, error) {
+	s.RLock()
+	defer s.RUnlock()
+	u, ok := s.Users[id]
+	if !ok {
+		return User{}, fmt.Errorf("%w: %d", ErrUnknownUser, id)
+	}
+	defer s.locks.lock(id)()
+	return *u, nil
+}
+
+// History returns a copy of the transcations done, in the order they are commited
+func (s *System) History() []Transcation {
+	s.RLock()
+	defer s.RUnlock()
+	s.history.Lock()
+	defer s.history.Unlock()
+	history := make([]Transcation, len(s.Transcations))
+	for i, t := range s.Transcations {
+		history[i] = *t
+	}
+	return history
+}
+
 // DoTransaction applys a transaction
 func (s *System) DoTransaction(t *Transcation) error {
-	// if after this transcation, user's cash is less than zero,
-	// rollback this transcation according to undo log.
-	s.Lock()
-	defer s.Unlock()
-
-	s.Transcations = append(s.Transcations, t)
+	if err := s.doTransaction(t); err != nil {
+		return err
+	}
+	// wait out of lock, so that concurrent transcations share one sync in group commit mode
+	return s.undoLog.WaitSync()
+}
 
-	var cashFrom, cashTo int
-	var ok bool
-	var userFrom, userTo *User
-	if userFrom, ok = s.Users[t.FromID]; ok {
-		cashFrom = userFrom.Cash
+func (s *System) doTransaction(t *Transcation) error {
+	s.RLock()
+	defer s.RUnlock()
+	userFrom, userTo, err := s.validate(t)
+	if err != nil {
+		return err
 	}
-	if userTo, ok = s.Users[t.ToID]; ok {
-		cashTo = userTo.Cash
+	unlock := s.locks.lock(t.FromID, t.ToID)
+	defer unlock()
+
+	cashFrom, cashTo := userFrom.Cash, userTo.Cash
+	// both users are locked, so the check holds until the transfer is done.
+	// Records of other transfers may follow ours in the log, so a failed
+	// transfer can not be popped, it must not be logged at all.
+	if cashFrom < t.Cash {
+		return fmt.Errorf("%w: %s with %d transfering %d", ErrInsufficientFunds, userFrom.Name, cashFrom, t.Cash)
 	}
 
-	s.writeUndoLog(t, cashFrom, cashTo)
+	if err = s.writeUndoLog(t, cashFrom, cashTo); err != nil {
+		return err
+	}
 
 	userFrom.Cash = cashFrom - t.Cash
 	userTo.Cash = cashTo + t.Cash
 
-	s.commitUndoLog(t)
-
-	if userFrom.Cash < 0 { //could check at the begnning of transaction, unless it's MVCC
-		s.undo()
-		return fmt.Errorf("Insufficient fund, %s with %d transfering %d", userFrom.Name, userFrom.Cash, t.Cash)
+	if err = s.commitUndoLog(t); err != nil {
+		return err
 	}
-
+	s.history.Lock()
+	s.Transcations = append(s.Transcations, t)
+	s.history.Unlock()
 	return nil
 }
 
+// validate checks a transfer before its users are locked, funds are checked
+// once they are. Returns users of the transfer.
+func (s *System) validate(t *Transcation) (*User, *User, error) {
+	if t.Cash <= 0 {
+		return nil, nil, fmt.Errorf("%w: %d", ErrNonPositiveAmount, t.Cash)
+	}
+	if t.FromID == t.ToID {
+		return nil, nil, fmt.Errorf("%w: %d", ErrSelfTransfer, t.FromID)
+	}
+	userFrom, ok := s.Users[t.FromID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnknownUser, t.FromID)
+	}
+	userTo, ok := s.Users[t.ToID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnknownUser, t.ToID)
+	}
+	return userFrom, userTo, nil
+}
+
 // writeUndoLog writes undo log to file
 func (s *System) writeUndoLog(t *Transcation, fromCash int, toCash int) error {
-	return s.undoLog.Write(&UndoItem{Cmd: write,
+	return s.undoLog.Write(s.newWriteItem(t, fromCash, toCash))
+}
+
+// newWriteItem returns the item of a transfer, a delta item if undo is logical,
+// or a write item with its before-images and after-images
+func (s *System) newWriteItem(t *Transcation, fromCash int, toCash int) *UndoItem {
+	if s.logical {
+		return &UndoItem{Cmd: delta,
+			TranscationID: t.TranscationID,
+			FromID:        t.FromID,
+			FromCash:      -t.Cash,
+			ToID:          t.ToID,
+			ToCash:        t.Cash,
+			Cash:          t.Cash,
+		}
+	}
+	return &UndoItem{Cmd: write,
 		TranscationID: t.TranscationID,
 		FromID:        t.FromID,
 		FromCash:      fromCash,
 		ToID:          t.ToID,
 		ToCash:        toCash,
 		Cash:          t.Cash,
-	})
+		FromAfter:     fromCash - t.Cash,
+		ToAfter:       toCash + t.Cash,
+	}
 }
 
 // commitUndoLog commit the transaction & write to file
@@ -102,55 +281,312 @@ func (s *System) commitUndoLog(t *Transcation) error {
 	return s.undoLog.Write(&UndoItem{Cmd: commit, TranscationID: t.TranscationID})
 }
 
-// gcUndoLog the old undo log
-func (s *System) gcUndoLog() {
-	s.undoLog.Purge()
+// abortUndoLog marks a rolled back transaction in file
+func (s *System) abortUndoLog(transcationID int) error {
+	return s.undoLog.Write(&UndoItem{Cmd: abort, TranscationID: transcationID})
 }
 
-func (s *System) undo() (int, error) {
-	log, err := s.undoLog.Read()
-	if err != nil {
-		return 0, err
+// gcUndoLog drops items older than the last checkpoint, which are covered by the snapshot.
+// It holds the read lock, so that it runs along with transfers but not while
+// the log is walked by undo or recovery.
+func (s *System) gcUndoLog() error {
+	s.RLock()
+	defer s.RUnlock()
+	return s.undoLog.PurgeToCheckpoint()
+}
+
+func (s *System) gcLoop(interval time.Duration) {
+	defer close(s.gcDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.gcUndoLog() // failed GC is tried again on next tick
+		case <-s.gcStop:
+			return
+		}
+	}
+}
+
+// undo restores the before-images of a write item, or subtracts the changes of a delta item
+func (s *System) undo(log *UndoItem) {
+	if log.Cmd == delta {
+		if user, ok := s.Users[log.ToID]; ok {
+			user.Cash -= log.ToCash
+		}
+		if user, ok := s.Users[log.FromID]; ok {
+			user.Cash -= log.FromCash
+		}
+		return
+	}
+	if user, ok := s.Users[log.ToID]; ok {
+		user.Cash = log.ToCash
 	}
-	if log.Cmd == commit {
-		if err = s.undoLog.Pop(); err != nil {
-			return 0, err
+	if user, ok := s.Users[log.FromID]; ok {
+		user.Cash = log.FromCash
+	}
+}
+
+// redo applies the after-images of a write item, or adds the changes of a delta item
+func (s *System) redo(log *UndoItem) {
+	if log.Cmd == delta {
+		if user, ok := s.Users[log.FromID]; ok {
+			user.Cash += log.FromCash
 		}
-		if log, err = s.undoLog.Read(); err != nil {
-			return 0, err
+		if user, ok := s.Users[log.ToID]; ok {
+			user.Cash += log.ToCash
 		}
+		return
+	}
+	fromCash, toCash := log.afterImages()
+	if user, ok := s.Users[log.FromID]; ok {
+		user.Cash = fromCash
+	}
+	if user, ok := s.Users[log.ToID]; ok {
+		user.Cash = toCash
 	}
+}
+
+// RollbackPending restores the before-images of transcations which were not
+// commited when the undo log was opened, e.g. after a crash, and writes an
+// abort item for each of them. Write items of all those transcations are
+// undone together, from the end of log backward. Call it after users are
+// added so the system starts in a consistent state.
+func (s *System) RollbackPending() error {
+	s.lockAll()
+	defer s.unlockAll()
 
-	s.Users[log.ToID].Cash = log.ToCash
-	s.Users[log.FromID].Cash = log.FromCash
-	if err = s.undoLog.Pop(); err != nil {
-		return 0, err
+	pending := s.undoLog.Pending()
+	if len(pending) == 0 {
+		return nil
+	}
+	ids := make(map[int]bool, len(pending))
+	for _, p := range pending {
+		ids[p.TranscationID] = true
+	}
+	first, _ := s.undoLog.Lookup(pending[0].TranscationID)
+	c := s.undoLog.Cursor()
+	item, err := c.SeekEnd()
+	for ; err == nil && item != nil && c.Offset() >= first; item, err = c.Prev() {
+		if isChange(item.Cmd) && ids[item.TranscationID] {
+			s.undo(item)
+		}
+	}
+	if err != nil {
+		return err
 	}
-	return log.TranscationID, nil
+	for i := len(pending) - 1; i >= 0; i-- {
+		if err := s.abortUndoLog(pending[i].TranscationID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// Aborted returns the transfers of transcations still in the undo log which
+// are rolled back, by RollbackPending, Recover, Tx.Rollback or a failed Revert.
+// Transfers are in the order they were logged, restores logged by
+// Tx.RollbackTo included.
+func (s *System) Aborted() ([]*Transcation, error) {
+	first, err := s.undoLog.Aborted()
+	if err != nil {
+		return nil, err
+	}
+	var transcations []*Transcation
+	for _, f := range first {
+		items, err := s.undoLog.Items(f.TranscationID)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if isChange(item.Cmd) {
+				transcations = append(transcations, &Transcation{item.TranscationID, item.FromID, item.ToID, item.Cash})
+			}
+		}
+	}
+	return transcations, nil
 }
 
 // UndoTranscation roll back some transcations
 func (s *System) UndoTranscation(fromID int) error {
 	// undo transcation from fromID to the last transcation
 
-	s.Lock()
-	defer s.Unlock()
+	s.lockAll()
+	defer s.unlockAll()
+
+	target, ok := s.undoLog.Lookup(fromID)
+	if !ok {
+		return ErrUnknownTranscation
+	}
+	return s.undoFrom(target)
+}
 
-	for true {
-		tid, err := s.undo()
+// UndoToLSN rolls back the item at lsn and every item after it. A transcation
+// begun before lsn keeps its items, as UndoTranscation does.
+func (s *System) UndoToLSN(lsn int64) error {
+	s.lockAll()
+	defer s.unlockAll()
+
+	target, err := s.undoLog.OffsetOf(lsn)
+	if err != nil {
+		return err
+	}
+	return s.undoFrom(target)
+}
+
+// undoFrom pops every item from the end of log back to offset target, and
+// undoes their changes. Transcations interleave their items, one begun before
+// target may go on after it. Its items are popped, then written back without
+// being undone, they get new LSNs. If a checkpoint item is popped, the
+// snapshot is ahead of the log, so a new checkpoint is taken. Transfers of
+// commited transcations undone are removed from Transcations. Changes of
+// aborted transcations were undone by their rollback, they are only popped.
+func (s *System) undoFrom(target int64) error {
+	var kept []*UndoItem
+	undone := make(map[int]bool)
+	aborted := make(map[int]bool) // abort item is popped before the changes
+	checkpointed := false
+	for s.undoLog.lastOffset() >= target {
+		last, err := s.undoLog.Read()
+		if err != nil {
+			return err
+		}
+		first := target
+		if last.Cmd != checkpoint {
+			first, _ = s.undoLog.Lookup(last.TranscationID)
+		}
+		log, err := s.undoLog.PopItem()
 		if err != nil {
 			return err
 		}
-		if tid == fromID {
-			//TODO: what if fromID does not exist. Load all undo log in memory, with a map
-			break
+		if first < target {
+			kept = append(kept, log)
+			continue
+		}
+		switch {
+		case log.Cmd == abort:
+			aborted[log.TranscationID] = true
+		case log.Cmd == begin || log.Cmd == commit:
+			delete(aborted, log.TranscationID) // an earlier one may reuse the id
+		case isChange(log.Cmd) && !aborted[log.TranscationID]:
+			s.undo(log)
 		}
+		undone[log.TranscationID] = undone[log.TranscationID] || log.Cmd == commit
+		checkpointed = checkpointed || log.Cmd == checkpoint
+	}
+	history := s.Transcations[:0]
+	for _, t := range s.Transcations {
+		if !undone[t.TranscationID] {
+			history = append(history, t)
+		}
+	}
+	s.Transcations = history
+	for i := len(kept) - 1; i >= 0; i-- {
+		if err := s.undoLog.Write(kept[i]); err != nil {
+			return err
+		}
+	}
+	if checkpointed && s.snapshotPath != "" {
+		return s.checkpoint()
 	}
 	return nil
 }
 
-// Close cleanup, close opened files
-func (s *System) Close() {
+// Revert adds transcation revertID, which transfers back every transfer of
+// transcationID in reverse order. Funds are checked as DoTransaction does, and
+// users held by other transfers are waited for. Transcations after
+// transcationID are left as they are. A revert item links revertID to
+// transcationID in the log.
+func (s *System) Revert(transcationID, revertID int) error {
+	if !s.startRevert(transcationID) {
+		return fmt.Errorf("%w: a revert is in flight", ErrAlreadyReverted)
+	}
+	defer s.endRevert(transcationID)
+	s.locks.openTx() // transcationID can not be undone until the revert ends
+	writes, err := s.revertible(transcationID)
+	if err != nil {
+		s.locks.closeTx()
+		return err
+	}
+	ids := make([]int, 0, 2*len(writes))
+	for _, w := range writes {
+		ids = append(ids, w.FromID, w.ToID)
+	}
+	tx, err := s.begin(revertID)
+	if err != nil {
+		return err
+	}
+	tx.hold(ids...) // users are known, so wait for them as a transfer does
+	err = s.undoLog.Write(&UndoItem{Cmd: revert, TranscationID: revertID, FromID: transcationID})
+	for i := len(writes) - 1; i >= 0 && err == nil; i-- {
+		err = tx.Write(writes[i].ToID, writes[i].FromID, writes[i].Cash)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// startRevert marks transcationID as being reverted until endRevert, it tells
+// false if it already is. Along with the check of revertible, this keeps two
+// reverts of one transcation from both committing.
+func (s *System) startRevert(transcationID int) bool {
+	s.revertMu.Lock()
+	defer s.revertMu.Unlock()
+	if s.reverting[transcationID] {
+		return false
+	}
+	s.reverting[transcationID] = true
+	return true
+}
+
+func (s *System) endRevert(transcationID int) {
+	s.revertMu.Lock()
+	defer s.revertMu.Unlock()
+	delete(s.reverting, transcationID)
+}
+
+// revertible returns write items of transcationID if it can be reverted
+func (s *System) revertible(transcationID int) ([]*UndoItem, error) {
+	items, err := s.undoLog.Items(transcationID)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrUnknownTranscation
+	}
+	if items[len(items)-1].Cmd != commit {
+		return nil, ErrNotCommited
+	}
+	if by, ok, err := s.undoLog.RevertedBy(transcationID); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, fmt.Errorf("%w by %d", ErrAlreadyReverted, by)
+	}
+	var writes []*UndoItem
+	for _, item := range items {
+		if isChange(item.Cmd) {
+			writes = append(writes, item)
+		}
+	}
+	return writes, nil
+}
+
+// Close cleanup, close opened files. With SnapshotPath, a checkpoint is taken first.
+func (s *System) Close() error {
+	if s.gcStop != nil { // before the lock, gcLoop may be waiting for it
+		close(s.gcStop)
+		<-s.gcDone
+		s.gcStop = nil
+	}
+	s.lockAll()
+	defer s.unlockAll()
+	var err error
+	if s.snapshotPath != "" {
+		err = s.checkpoint()
+	}
 	s.undoLog.Close()
+	return err
 }
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"testing"
 )
 
@@ -172,3 +174,432 @@ func TestUndoTransaction(t *testing.T) {
 	}
 
 }
+
+func TestRollbackPending(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	u3 := &User{3, "u3", 9}
+	u2 := &User{2, "u2", 5}
+	s.AddUser(u3)
+	s.AddUser(u2)
+	if err := s.DoTransaction(&Transcation{1, 3, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	// crash after the balances are changed, before commit
+	s.writeUndoLog(&Transcation{2, 3, 2, 4}, u3.Cash, u2.Cash)
+	s.undoLog.file.Close()
+
+	s = NewSystem()
+	defer s.Close()
+	pending := s.undoLog.Pending()
+	if len(pending) != 1 || pending[0].TranscationID != 2 {
+		t.Fatalf("pending transcations are %v", pending)
+	}
+	u3 = &User{3, "u3", 2}
+	u2 = &User{2, "u2", 12}
+	s.AddUser(u3)
+	s.AddUser(u2)
+	if err := s.RollbackPending(); err != nil {
+		t.Fatal(err)
+	}
+	if u3.Cash != 6 || u2.Cash != 8 {
+		t.Errorf("before-images are not restored, u3 %d u2 %d", u3.Cash, u2.Cash)
+	}
+	if len(s.undoLog.Pending()) != 0 {
+		t.Error("pending transcations are not removed")
+	}
+	s.Close()
+
+	// write+abort is resolved in the next openning
+	s = NewSystem()
+	defer s.Close()
+	s.AddUser(u3)
+	s.AddUser(u2)
+	if len(s.undoLog.Pending()) != 0 {
+		t.Error("aborted transcations are pending")
+	}
+	aborted, err := s.Aborted()
+	if err != nil || len(aborted) != 1 || *aborted[0] != (Transcation{2, 3, 2, 4}) {
+		t.Errorf("aborted transcations are %v, %v", aborted, err)
+	}
+	if err := s.UndoTranscation(1); err != nil || u3.Cash != 9 || u2.Cash != 5 {
+		t.Errorf("undo after rollback failed, %v", err)
+	}
+}
+
+func TestUndoUnknownTransaction(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	defer s.Close()
+	u3 := &User{3, "u3", 9}
+	u2 := &User{2, "u2", 5}
+	s.AddUser(u3)
+	s.AddUser(u2)
+	s.DoTransaction(&Transcation{1, 3, 2, 3})
+	s.DoTransaction(&Transcation{2, 3, 2, 3})
+
+	if err := s.UndoTranscation(7); err != ErrUnknownTranscation {
+		t.Errorf("undo unknown transcation returns %v", err)
+	}
+	if u3.Cash != 3 || u2.Cash != 11 {
+		t.Error("undo unknown transcation changes balances")
+	}
+}
+
+func TestNewSystemWithOptions(t *testing.T) {
+	os.Remove("./system.bin")
+	defer os.Remove("./system.bin")
+	s, err := NewSystemWithOptions(SystemOptions{LogPath: "./system.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := os.Stat("./system.bin"); err != nil {
+		t.Errorf("log is not created at LogPath, %v", err)
+	}
+
+	os.WriteFile("./system.bin", []byte("damaged"), 0640)
+	if s, err = NewSystemWithOptions(SystemOptions{LogPath: "./system.bin"}); err == nil || s != nil {
+		t.Error("system opens a damaged log without error")
+	}
+}
+
+func TestParallelTransaction(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	defer s.Close()
+
+	const count = 8
+	for id := 0; id < count; id++ {
+		s.AddUser(&User{id, fmt.Sprintf("u%d", id), 100})
+	}
+	s.DoTransaction(&Transcation{1, 0, 1, 1})
+
+	// transfers around a ring, in both directions, share users with their neighbours
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				from := (g + i) % count
+				to := (from + 1 + g%2*(count-2)) % count
+				s.DoTransaction(&Transcation{2 + g*1000 + i, from, to, 1 + i%3})
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, user := range s.Users {
+		total += user.Cash
+	}
+	if total != count*100 {
+		t.Errorf("total cash is %d after parallel transfers", total)
+	}
+
+	if err := s.UndoTranscation(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range s.Users {
+		if user.Cash != 100 {
+			t.Errorf("%s has %d after undo", user.Name, user.Cash)
+		}
+	}
+}
+
+func TestUndoInterleavedTransaction(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	defer s.Close()
+	u1, u2, u3, u4 := &User{1, "u1", 10}, &User{2, "u2", 10}, &User{3, "u3", 10}, &User{4, "u4", 10}
+	for _, u := range []*User{u1, u2, u3, u4} {
+		s.AddUser(u)
+	}
+
+	// tx 1 starts before tx 2 and commits after it
+	s.writeUndoLog(&Transcation{1, 1, 2, 5}, 10, 10)
+	u1.Cash, u2.Cash = 5, 15
+	s.DoTransaction(&Transcation{2, 3, 4, 5})
+	s.commitUndoLog(&Transcation{1, 1, 2, 5})
+	s.DoTransaction(&Transcation{3, 4, 1, 5})
+
+	if err := s.UndoTranscation(2); err != nil {
+		t.Fatal(err)
+	}
+	if u1.Cash != 5 || u2.Cash != 15 || u3.Cash != 10 || u4.Cash != 10 {
+		t.Errorf("undo tx 2 gives %d %d %d %d", u1.Cash, u2.Cash, u3.Cash, u4.Cash)
+	}
+	if err := s.UndoTranscation(1); err != nil {
+		t.Fatalf("commit of tx 1 is lost, %v", err)
+	}
+	if u1.Cash != 10 || u2.Cash != 10 {
+		t.Errorf("undo tx 1 gives %d %d", u1.Cash, u2.Cash)
+	}
+}
+
+func TestRollbackInterleavedPending(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	u1, u2, u3, u4 := &User{1, "u1", 10}, &User{2, "u2", 10}, &User{3, "u3", 10}, &User{4, "u4", 10}
+	for _, u := range []*User{u1, u2, u3, u4} {
+		s.AddUser(u)
+	}
+	// crash while tx 1 is in flight, after tx 2 is done
+	s.writeUndoLog(&Transcation{1, 1, 2, 5}, 10, 10)
+	s.DoTransaction(&Transcation{2, 3, 4, 5})
+	s.undoLog.file.Close()
+
+	s = NewSystem()
+	defer s.Close()
+	u1, u2, u3, u4 = &User{1, "u1", 5}, &User{2, "u2", 15}, &User{3, "u3", 5}, &User{4, "u4", 15}
+	for _, u := range []*User{u1, u2, u3, u4} {
+		s.AddUser(u)
+	}
+	if err := s.RollbackPending(); err != nil {
+		t.Fatal(err)
+	}
+	if u1.Cash != 10 || u2.Cash != 10 || u3.Cash != 5 || u4.Cash != 15 {
+		t.Errorf("rollback gives %d %d %d %d", u1.Cash, u2.Cash, u3.Cash, u4.Cash)
+	}
+	if err := s.UndoTranscation(2); err != nil || u3.Cash != 10 || u4.Cash != 10 {
+		t.Errorf("tx 2 is lost by rollback, %v", err)
+	}
+}
+
+func TestRejectedTransaction(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	defer s.Close()
+	s.AddUser(&User{1, "u1", 10})
+	s.AddUser(&User{2, "u2", 10})
+
+	rejected := []struct {
+		transcation Transcation
+		err         error
+	}{
+		{Transcation{1, 1, 3, 5}, ErrUnknownUser},
+		{Transcation{2, 3, 1, 5}, ErrUnknownUser},
+		{Transcation{3, 1, 2, 11}, ErrInsufficientFunds},
+		{Transcation{4, 1, 1, 5}, ErrSelfTransfer},
+		{Transcation{5, 1, 2, 0}, ErrNonPositiveAmount},
+		{Transcation{6, 1, 2, -5}, ErrNonPositiveAmount},
+	}
+	for _, r := range rejected {
+		if err := s.DoTransaction(&r.transcation); !errors.Is(err, r.err) {
+			t.Errorf("transcation %d returns %v, want %v", r.transcation.TranscationID, err, r.err)
+		}
+	}
+	if item, _ := s.undoLog.Read(); item != nil {
+		t.Error("rejected transcations reach undo log")
+	}
+	if len(s.Transcations) != 0 {
+		t.Error("rejected transcations are recorded")
+	}
+	if s.Users[1].Cash != 10 || s.Users[2].Cash != 10 {
+		t.Error("rejected transcations change balances")
+	}
+}
+
+func TestRevert(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	defer s.Close()
+	u1, u2, u3 := &User{1, "u1", 10}, &User{2, "u2", 10}, &User{3, "u3", 10}
+	for _, u := range []*User{u1, u2, u3} {
+		s.AddUser(u)
+	}
+	s.DoTransaction(&Transcation{1, 1, 2, 5})
+	s.DoTransaction(&Transcation{2, 2, 3, 3})
+
+	if err := s.Revert(1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if u1.Cash != 10 || u2.Cash != 7 || u3.Cash != 13 {
+		t.Errorf("revert gives %d %d %d", u1.Cash, u2.Cash, u3.Cash)
+	}
+	if by, ok, err := s.undoLog.RevertedBy(1); err != nil || !ok || by != 3 {
+		t.Errorf("transcation 1 is reverted by %d %v, %v", by, ok, err)
+	}
+	if err := s.Revert(1, 4); !errors.Is(err, ErrAlreadyReverted) {
+		t.Errorf("revert twice returns %v", err)
+	}
+	if err := s.Revert(99, 4); err != ErrUnknownTranscation {
+		t.Errorf("revert unknown transcation returns %v", err)
+	}
+
+	// u3 spends what it got from transcation 2, so it can not be reverted
+	s.DoTransaction(&Transcation{4, 3, 1, 13})
+	if err := s.Revert(2, 5); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("revert without funds returns %v", err)
+	}
+	if u1.Cash != 23 || u2.Cash != 7 || u3.Cash != 0 {
+		t.Errorf("failed revert gives %d %d %d", u1.Cash, u2.Cash, u3.Cash)
+	}
+	if _, ok, _ := s.undoLog.RevertedBy(2); ok {
+		t.Error("failed revert is linked")
+	}
+}
+
+func TestRevertWaitsTransfers(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	defer s.Close()
+	u1, u2 := &User{1, "u1", 100}, &User{2, "u2", 100}
+	s.AddUser(u1)
+	s.AddUser(u2)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() { // steady transfers on the same users
+		defer close(done)
+		for i := 1000; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.DoTransaction(&Transcation{i, 1 + i%2, 2 - i%2, 1})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		s.DoTransaction(&Transcation{i*2 + 1, 1, 2, 1})
+		if err := s.Revert(i*2+1, i*2+2); err != nil {
+			t.Errorf("revert under transfers returns %v", err)
+		}
+	}
+	close(stop)
+	<-done
+	if u1.Cash+u2.Cash != 200 {
+		t.Errorf("users have %d %d", u1.Cash, u2.Cash)
+	}
+}
+
+func TestRevertConcurrent(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	defer s.Close()
+	u1, u2 := &User{1, "u1", 100}, &User{2, "u2", 100}
+	s.AddUser(u1)
+	s.AddUser(u2)
+	s.DoTransaction(&Transcation{1, 1, 2, 5})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(revertID int) {
+			defer wg.Done()
+			errs <- s.Revert(1, revertID)
+		}(10 + i)
+	}
+	wg.Wait()
+	close(errs)
+	reverted := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			reverted++
+		case !errors.Is(err, ErrAlreadyReverted):
+			t.Errorf("concurrent revert returns %v", err)
+		}
+	}
+	if reverted != 1 || u1.Cash != 100 || u2.Cash != 100 {
+		t.Errorf("%d concurrent reverts commit, users have %d %d", reverted, u1.Cash, u2.Cash)
+	}
+}
+
+func TestLogicalUndo(t *testing.T) {
+	os.Remove("./undo.bin")
+	s, err := NewSystemWithOptions(SystemOptions{LogicalUndo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, u2, u3 := &User{1, "u1", 10}, &User{2, "u2", 10}, &User{3, "u3", 10}
+	for _, u := range []*User{u1, u2, u3} {
+		s.AddUser(u)
+	}
+	s.DoTransaction(&Transcation{1, 1, 2, 5})
+	s.DoTransaction(&Transcation{2, 3, 1, 4})
+	if items, _ := s.undoLog.Items(2); items[0].Cmd != delta || items[0].FromCash != -4 || items[0].ToCash != 4 {
+		t.Errorf("transfer is logged as %v", items[0])
+	}
+	u2.Cash += 100 // a deposit which is not logged
+	if err := s.UndoTranscation(1); err != nil {
+		t.Fatal(err)
+	}
+	if u1.Cash != 10 || u2.Cash != 110 || u3.Cash != 10 {
+		t.Errorf("logical undo gives %d %d %d", u1.Cash, u2.Cash, u3.Cash)
+	}
+
+	// a rolled back transcation is not subtracted again by undo
+	s.DoTransaction(&Transcation{4, 1, 2, 3})
+	tx, _ := s.Begin(5)
+	tx.Write(1, 2, 5)
+	tx.Rollback()
+	if err := s.UndoTranscation(4); err != nil {
+		t.Fatal(err)
+	}
+	if u1.Cash != 10 || u2.Cash != 110 || u3.Cash != 10 {
+		t.Errorf("undo after a rollback gives %d %d %d", u1.Cash, u2.Cash, u3.Cash)
+	}
+
+	// crash in a transcation, recovery subtracts its changes
+	tx, _ = s.Begin(3)
+	tx.Write(2, 3, 50)
+	tx.Write(3, 1, 20)
+	s.undoLog.file.Close()
+
+	s = NewSystem()
+	defer s.Close()
+	u1, u2, u3 = &User{1, "u1", 30}, &User{2, "u2", 60}, &User{3, "u3", 40}
+	for _, u := range []*User{u1, u2, u3} {
+		s.AddUser(u)
+	}
+	if err := s.RollbackPending(); err != nil {
+		t.Fatal(err)
+	}
+	if u1.Cash != 10 || u2.Cash != 110 || u3.Cash != 10 {
+		t.Errorf("logical recovery gives %d %d %d", u1.Cash, u2.Cash, u3.Cash)
+	}
+}
+
+func TestUndoToLSN(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	defer s.Close()
+	u1, u2 := &User{1, "u1", 10}, &User{2, "u2", 10}
+	s.AddUser(u1)
+	s.AddUser(u2)
+	s.DoTransaction(&Transcation{1, 1, 2, 1})
+	lsn := s.undoLog.NextLSN()
+	s.DoTransaction(&Transcation{2, 1, 2, 2})
+	s.DoTransaction(&Transcation{3, 2, 1, 4})
+
+	if err := s.UndoToLSN(lsn); err != nil {
+		t.Fatal(err)
+	}
+	if u1.Cash != 9 || u2.Cash != 11 {
+		t.Errorf("undo to LSN %d gives %d %d", lsn, u1.Cash, u2.Cash)
+	}
+	if _, ok := s.undoLog.Lookup(2); ok {
+		t.Error("transcation after LSN is kept")
+	}
+	if err := s.UndoToLSN(lsn); err != ErrUnknownLSN {
+		t.Errorf("undo to a popped LSN returns %v", err)
+	}
+}
+
+func TestHistoryFailedLog(t *testing.T) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	s.AddUser(&User{1, "u1", 10})
+	s.AddUser(&User{2, "u2", 10})
+	s.undoLog.Close()
+	if err := s.DoTransaction(&Transcation{1, 1, 2, 5}); !errors.Is(err, ErrLogClosed) {
+		t.Errorf("transfer on a closed log returns %v", err)
+	}
+	if history := s.History(); len(history) != 0 {
+		t.Errorf("history keeps a transfer never commited: %v", history)
+	}
+}
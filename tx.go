@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTxDone is returned when a Tx is used after Commit or Rollback
+var ErrTxDone = errors.New("transcation is already commited or rolled back")
+
+// ErrUnknownSavepoint is returned when RollbackTo a savepoint which is not set
+var ErrUnknownSavepoint = errors.New("savepoint does not exist")
+
+// ErrLockConflict is returned when a user is held by another transcation. The
+// Tx is left as is, caller may roll it back and try again.
+var ErrLockConflict = errors.New("user is locked by another transcation")
+
+// Tx is a transcation of any number of transfers. It is logged as a begin
+// item, a write or delta item for each transfer, then a commit or an abort
+// item. A Tx holds the users it changes until Commit or Rollback, so it must
+// end with one of them. A Tx is used by one goroutine.
+type Tx struct {
+	s         *System
+	id        int
+	users     []int       // users held by the Tx
+	writes    []*UndoItem // write items logged, in the order they were written
+	transfers []*Transcation
+	points    []txSavepoint
+	logged    int // savepoint items logged
+	done      bool
+}
+
+// txSavepoint is a savepoint of a Tx, transfers after it are rolled back by RollbackTo
+type txSavepoint struct {
+	name   string
+	writes int // count of writes when it is set
+	seq    int // savepoint item of the Tx it is logged as, from 1
+}
+
+// Begin starts a transcation. System wide operations, e.g. AddUser,
+// UndoTranscation or Checkpoint, wait until it ends, so the goroutine holding
+// it must not call them. Other calls, transfers and Begin included, may be
+// made; those on users the Tx holds wait for it as well.
+func (s *System) Begin(transcationID int) (*Tx, error) {
+	s.locks.openTx()
+	return s.begin(transcationID)
+}
+
+// begin starts a transcation already counted open, it is no more if begin fails
+func (s *System) begin(transcationID int) (*Tx, error) {
+	if err := s.undoLog.Write(&UndoItem{Cmd: begin, TranscationID: transcationID}); err != nil {
+		s.locks.closeTx()
+		return nil, err
+	}
+	return &Tx{s: s, id: transcationID}, nil
+}
+
+// ID returns id of the transcation
+func (tx *Tx) ID() int {
+	return tx.id
+}
+
+// Write transfers cash from user fromID to user toID within the transcation.
+// The transfer is validated like DoTransaction does, a rejected one is not
+// logged and leaves the transcation open.
+func (tx *Tx) Write(fromID, toID, cash int) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.s.RLock()
+	defer tx.s.RUnlock()
+	t := &Transcation{tx.id, fromID, toID, cash}
+	userFrom, userTo, err := tx.s.validate(t)
+	if err != nil {
+		return err
+	}
+	if err = tx.lock(fromID); err != nil {
+		return err
+	}
+	if err = tx.lock(toID); err != nil {
+		return err
+	}
+	if userFrom.Cash < cash {
+		return fmt.Errorf("%w: %s with %d transfering %d", ErrInsufficientFunds, userFrom.Name, userFrom.Cash, cash)
+	}
+
+	item := tx.s.newWriteItem(t, userFrom.Cash, userTo.Cash)
+	if err = tx.s.undoLog.Write(item); err != nil {
+		return err
+	}
+	tx.writes = append(tx.writes, item)
+	tx.transfers = append(tx.transfers, t)
+	userFrom.Cash -= cash
+	userTo.Cash += cash
+	return nil
+}
+
+// Savepoint logs a savepoint item, so that RollbackTo(name) rolls back the
+// transfers after it and keeps the transcation open. A name set again moves
+// to the new point. Names are not logged, savepoint items are known by their
+// order in the transcation.
+func (tx *Tx) Savepoint(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.s.undoLog.Write(&UndoItem{Cmd: savepoint, TranscationID: tx.id}); err != nil {
+		return err
+	}
+	tx.logged++
+	tx.points = append(tx.points, txSavepoint{name, len(tx.writes), tx.logged})
+	return nil
+}
+
+// RollbackTo restores the before-images of transfers after savepoint name, in
+// reverse order. A rollbackTo item naming the savepoint item is logged first,
+// then each restore as a write item of the reverse transfer, so that undoing
+// the whole transcation later still restores every step. Savepoints set after
+// name are released, name itself is kept.
+func (tx *Tx) RollbackTo(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	i := len(tx.points) - 1
+	for i >= 0 && tx.points[i].name != name {
+		i--
+	}
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownSavepoint, name)
+	}
+	tx.s.RLock()
+	defer tx.s.RUnlock()
+	point := tx.points[i]
+	if err := tx.s.undoLog.Write(&UndoItem{Cmd: rollbackTo, TranscationID: tx.id, FromID: point.seq}); err != nil {
+		return err
+	}
+	for len(tx.writes) > point.writes {
+		n := len(tx.writes) - 1
+		w := tx.writes[n]
+		reverse := &Transcation{tx.id, w.ToID, w.FromID, w.Cash}
+		from, to := tx.s.Users[w.ToID], tx.s.Users[w.FromID]
+		if err := tx.s.writeUndoLog(reverse, from.Cash, to.Cash); err != nil {
+			return err
+		}
+		tx.s.undo(w)
+		tx.writes = tx.writes[:n]
+		tx.transfers = tx.transfers[:n]
+	}
+	tx.points = tx.points[:i+1]
+	return nil
+}
+
+// lock holds user id until the transcation ends. It does not wait for other
+// transcations, so that two of them never wait for each other.
+func (tx *Tx) lock(id int) error {
+	for _, held := range tx.users {
+		if held == id {
+			return nil
+		}
+	}
+	if !tx.s.locks.tryLock(id) {
+		return fmt.Errorf("%w: %d", ErrLockConflict, id)
+	}
+	tx.users = append(tx.users, id)
+	return nil
+}
+
+// hold waits for users ids, in ascending order as transfers do, and holds them
+// until the transcation ends. The Tx must not hold any user yet, or it may
+// wait for a transcation waiting for it.
+func (tx *Tx) hold(ids ...int) {
+	tx.s.locks.lock(ids...) // released by end, one by one
+	for _, id := range ids {
+		held := false
+		for _, h := range tx.users {
+			held = held || h == id
+		}
+		if !held {
+			tx.users = append(tx.users, id)
+		}
+	}
+}
+
+// Commit logs a commit item and ends the transcation. If it can not be
+// logged, the transcation is rolled back.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.s.commitUndoLog(&Transcation{TranscationID: tx.id}); err != nil {
+		tx.rollback()
+		tx.end()
+		return err
+	}
+	tx.s.history.Lock()
+	tx.s.Transcations = append(tx.s.Transcations, tx.transfers...)
+	tx.s.history.Unlock()
+	tx.end()
+	return tx.s.undoLog.WaitSync()
+}
+
+// Rollback restores the before-images of every transfer in reverse order,
+// logs an abort item and ends the transcation.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	defer tx.end()
+	return tx.rollback()
+}
+
+func (tx *Tx) rollback() error {
+	tx.s.RLock()
+	defer tx.s.RUnlock()
+	for i := len(tx.writes) - 1; i >= 0; i-- {
+		tx.s.undo(tx.writes[i])
+	}
+	return tx.s.abortUndoLog(tx.id)
+}
+
+// end releases users held and lets System wide operations in
+func (tx *Tx) end() {
+	tx.done = true
+	for i := len(tx.users) - 1; i >= 0; i-- {
+		tx.s.locks.unlock(tx.users[i])
+	}
+	tx.s.locks.closeTx()
+}
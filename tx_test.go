@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTxSystem(t *testing.T) (*System, []*User) {
+	os.Remove("./undo.bin")
+	s := NewSystem()
+	users := []*User{{1, "u1", 10}, {2, "u2", 10}, {3, "u3", 10}}
+	for _, u := range users {
+		s.AddUser(u)
+	}
+	return s, users
+}
+
+func cashOf(users []*User) [3]int {
+	return [3]int{users[0].Cash, users[1].Cash, users[2].Cash}
+}
+
+func TestTxCommitRollback(t *testing.T) {
+	s, users := newTxSystem(t)
+	defer s.Close()
+
+	tx, err := s.Begin(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Write(1, 2, 5)
+	tx.Write(2, 3, 8)
+	if err := tx.Write(1, 3, 6); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("overdraft in transcation returns %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if cashOf(users) != [3]int{5, 7, 18} {
+		t.Errorf("commit gives %v", cashOf(users))
+	}
+	if err := tx.Write(1, 2, 1); err != ErrTxDone {
+		t.Errorf("write after commit returns %v", err)
+	}
+
+	tx, _ = s.Begin(2)
+	tx.Write(3, 1, 10)
+	tx.Write(1, 2, 15)
+	tx.Write(2, 3, 22)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if cashOf(users) != [3]int{5, 7, 18} {
+		t.Errorf("rollback gives %v", cashOf(users))
+	}
+	if aborted, _ := s.undoLog.Aborted(); len(aborted) != 1 || aborted[0].TranscationID != 2 {
+		t.Errorf("aborted transcations are %v", aborted)
+	}
+	aborted, err := s.Aborted()
+	if err != nil || len(aborted) != 3 || *aborted[0] != (Transcation{2, 3, 1, 10}) || *aborted[2] != (Transcation{2, 2, 3, 22}) {
+		t.Errorf("aborted transfers are %v, %v", aborted, err)
+	}
+
+	if err := s.UndoTranscation(1); err != nil {
+		t.Fatal(err)
+	}
+	if cashOf(users) != [3]int{10, 10, 10} {
+		t.Errorf("undo gives %v", cashOf(users))
+	}
+	if item, _ := s.undoLog.Read(); item != nil {
+		t.Errorf("undo leaves %v in log", item)
+	}
+}
+
+func TestTxLockConflict(t *testing.T) {
+	s, users := newTxSystem(t)
+	defer s.Close()
+
+	tx1, _ := s.Begin(1)
+	tx2, _ := s.Begin(2)
+	if err := tx1.Write(1, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Write(3, 2, 1); !errors.Is(err, ErrLockConflict) {
+		t.Errorf("write to a held user returns %v", err)
+	}
+	tx2.Rollback()
+	tx1.Commit()
+	if cashOf(users) != [3]int{9, 11, 10} {
+		t.Errorf("transcations give %v", cashOf(users))
+	}
+}
+
+func TestTxRecovery(t *testing.T) {
+	s, users := newTxSystem(t)
+	s.DoTransaction(&Transcation{1, 3, 1, 2})
+	tx, _ := s.Begin(2)
+	tx.Write(1, 2, 5)
+	tx.Write(2, 3, 8)
+	// crash before commit
+	s.undoLog.file.Close()
+	crashed := cashOf(users)
+
+	s = NewSystem()
+	defer s.Close()
+	users = []*User{{1, "u1", crashed[0]}, {2, "u2", crashed[1]}, {3, "u3", crashed[2]}}
+	for _, u := range users {
+		s.AddUser(u)
+	}
+	if err := s.RollbackPending(); err != nil {
+		t.Fatal(err)
+	}
+	if cashOf(users) != [3]int{12, 10, 8} {
+		t.Errorf("recovery gives %v", cashOf(users))
+	}
+}
+
+func TestTxSavepoint(t *testing.T) {
+	s, users := newTxSystem(t)
+
+	tx, _ := s.Begin(1)
+	tx.Write(1, 2, 5)
+	tx.Savepoint("leg1")
+	tx.Write(2, 3, 8)
+	tx.Savepoint("leg2")
+	tx.Write(3, 1, 10)
+	if err := tx.RollbackTo("leg1"); err != nil {
+		t.Fatal(err)
+	}
+	if cashOf(users) != [3]int{5, 15, 10} {
+		t.Errorf("rollback to leg1 gives %v", cashOf(users))
+	}
+	if err := tx.RollbackTo("leg2"); !errors.Is(err, ErrUnknownSavepoint) {
+		t.Errorf("rollback to a released savepoint returns %v", err)
+	}
+	tx.Write(2, 3, 1)
+	if err := tx.RollbackTo("leg1"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Write(2, 1, 2)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if cashOf(users) != [3]int{7, 13, 10} {
+		t.Errorf("commit gives %v", cashOf(users))
+	}
+	if len(s.Transcations) != 2 {
+		t.Errorf("history keeps %d transfers", len(s.Transcations))
+	}
+	var restored []int
+	items, _ := s.undoLog.Items(1)
+	for _, item := range items {
+		if item.Cmd == rollbackTo {
+			restored = append(restored, item.Savepoint())
+		}
+	}
+	if len(restored) != 2 || restored[0] != 1 || restored[1] != 1 {
+		t.Errorf("rollbacks are logged to savepoints %v", restored)
+	}
+
+	// a crash after a partial rollback restores the beginning
+	tx, _ = s.Begin(2)
+	tx.Write(2, 3, 4)
+	tx.Savepoint("leg1")
+	tx.Write(3, 1, 6)
+	tx.RollbackTo("leg1")
+	s.undoLog.file.Close()
+	crashed := cashOf(users)
+
+	s = NewSystem()
+	defer s.Close()
+	users = []*User{{1, "u1", crashed[0]}, {2, "u2", crashed[1]}, {3, "u3", crashed[2]}}
+	for _, u := range users {
+		s.AddUser(u)
+	}
+	if err := s.RollbackPending(); err != nil {
+		t.Fatal(err)
+	}
+	if cashOf(users) != [3]int{7, 13, 10} {
+		t.Errorf("recovery gives %v", cashOf(users))
+	}
+	if err := s.UndoTranscation(1); err != nil || cashOf(users) != [3]int{10, 10, 10} {
+		t.Errorf("undo gives %v, %v", cashOf(users), err)
+	}
+}
+
+func TestTxCallsWhileWaited(t *testing.T) {
+	s, users := newTxSystem(t)
+	s.AddUser(&User{4, "u4", 10})
+
+	// a transfer waits for user 1 held by tx, AddUser and UndoTranscation wait
+	// for tx; calls of tx and on users it does not hold go on
+	tx, _ := s.Begin(1)
+	tx.Write(1, 2, 5)
+	queued := make(chan error, 3)
+	go func() { queued <- s.DoTransaction(&Transcation{5, 1, 3, 1}) }()
+	time.Sleep(20 * time.Millisecond)
+	go func() { queued <- s.AddUser(&User{5, "u5", 10}) }()
+	go func() { queued <- s.UndoTranscation(1) }()
+	time.Sleep(20 * time.Millisecond)
+
+	calls := make(chan error, 1)
+	go func() {
+		if _, err := s.User(3); err != nil {
+			calls <- err
+			return
+		}
+		if err := s.DoTransaction(&Transcation{2, 3, 4, 1}); err != nil {
+			calls <- err
+			return
+		}
+		s.History()
+		nested, err := s.Begin(3)
+		if err == nil {
+			nested.Write(4, 3, 2)
+			err = nested.Commit()
+		}
+		if err == nil {
+			err = tx.Write(1, 2, 1)
+		}
+		calls <- err
+	}()
+	select {
+	case err := <-calls:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("calls within a transcation block behind a System wide operation")
+	}
+	select {
+	case err := <-queued:
+		t.Fatalf("a call returns %v before the transcation ends", err)
+	default:
+	}
+
+	tx.Commit()
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-queued:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("calls waiting for the transcation do not end")
+		}
+	}
+	if total := cashOf(users)[0] + cashOf(users)[1] + cashOf(users)[2] + s.Users[4].Cash + s.Users[5].Cash; total != 50 {
+		t.Errorf("users have %v %d %d after the transcation", cashOf(users), s.Users[4].Cash, s.Users[5].Cash)
+	}
+	s.Close()
+}
@@ -4,37 +4,153 @@ import (
 	"bufio"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"sync"
+	"time"
 )
 
-var errHeaderOffsetNotMatch = errors.New("file header offset does not match file size")
+var errHeaderOffsetNotMatch = errors.New("file header offset does not match file size, file is not closed properly")
 var errRecoverFail = errors.New("recover file failed")
+var errChecksumMismatch = errors.New("checksum mismatch")
+var errUnknownItem = errors.New("unknown item type")
+var errPendingNotLast = errors.New("pending item is not the last item in file")
+var errOffsetOutOfRange = errors.New("offset is out of range of items")
+
+// ErrLogClosed is returned by calls on an UndoLog already closed
+var ErrLogClosed = errors.New("undo log is closed")
+
+// ErrUnknownLSN is returned when no item in log has the LSN
+var ErrUnknownLSN = errors.New("lsn does not exist")
+
+// maxItemSize bounds reading of a single item
+const maxItemSize = 1 << 20
+
+// CorruptionError is returned when the item at Offset can not be trusted,
+// either it fails the checksum or it is cut short by the end of file.
+type CorruptionError struct {
+	Offset int64
+	Err    error
+}
+
+func newCorruptionError(offset int64, err error) error {
+	if err != errChecksumMismatch && err != errUnknownItem && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return &CorruptionError{Offset: offset, Err: err}
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("undo log corrupted at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// isTornWrite tells if err is caused by an item cut short by the end of file
+func isTornWrite(err error) bool {
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		return false
+	}
+	return corruption.Err == io.EOF || corruption.Err == io.ErrUnexpectedEOF
+}
 
 type fromToBinary interface {
-	ToBinary(w io.Writer, currentOffset int64, prevOffset int64) (int64, error)
-	FromBinary(r io.Reader) (int64, error)
+	ToBinary(w io.Writer, version int, currentOffset int64, prevOffset int64) (int64, error)
+	FromBinary(r io.Reader, version int) (int64, error)
 	NextOffset() int64
 	PrevOffset() int64
 }
 
-// UndoLog manage file read\write
-// TODO: log file rotate, maybe add an index file
+// UndoLog manage file read\write. It is safe for concurrent use: writes are
+// serialized, reads see the log as of the last write done.
 type UndoLog struct {
+	mu          sync.RWMutex
+	closed      bool
 	fileName    string
-	file        *os.File
+	opts        Options
+	segments    []*segment  // in order, the last one is active, i.e. written to
+	file        *os.File    // file of active segment
+	header      *fileHeader // header of active segment
 	writeOffset int64
 	readOffset  int64 //only for read
-	prevOffset  int64 //offset of previous item to be read.
+	nextLSN     int64 // LSN of the next item written
 	w           *bufio.Writer
-	r           *bufio.Reader
-	header      *fileHeader
+	pending     []pendingItem // first items of transcations without commit, found on open
+	index       txIndex
+	indexFile   bool // keep index in a sidecar file
+	sync        *syncer
 }
 
-// NewUndoLog create log with filename
-func NewUndoLog(name string) *UndoLog {
-	u := &UndoLog{fileName: name}
+type pendingItem struct {
+	offset int64
+	item   *UndoItem
+}
+
+// Options tunes an UndoLog, the zero value keeps the whole log in a single file.
+type Options struct {
+	// SegmentSize starts a new segment file once the active one reaches this size, 0 for no limit.
+	SegmentSize int64
+	// RetainSegments is the number of latest segments to keep. Older ones are deleted
+	// once every transcation in them is commited. 0 keeps all segments.
+	RetainSegments int
+	// Sync decides when items are synced to disk, the default syncs every write.
+	Sync SyncMode
+	// SyncInterval is the period of SyncInterval mode, 100ms if not set.
+	SyncInterval time.Duration
+	// FileMode is the permission of files created, 0640 if not set.
+	FileMode os.FileMode
+	// Exclusive fails to open a log which already exists.
+	Exclusive bool
+	// Recovery decides what to do with a log not closed properly.
+	Recovery RecoveryMode
+}
+
+// RecoveryMode decides what Open does with a log not closed properly
+type RecoveryMode int
+
+const (
+	// RecoverRepair updates header and truncates a torn item at the end of file, the default
+	RecoverRepair RecoveryMode = iota
+	// RecoverStrict fails to open, and leaves the file untouched
+	RecoverStrict
+)
+
+const defaultFileMode os.FileMode = 0640
+
+func (l *UndoLog) fileMode() os.FileMode {
+	if l.opts.FileMode == 0 {
+		return defaultFileMode
+	}
+	return l.opts.FileMode
+}
+
+// OpenUndoLog opens log at path, it is created if not exists.
+// Segment files are named after path.
+func OpenUndoLog(path string, opts Options) (*UndoLog, error) {
+	u := &UndoLog{fileName: path, opts: opts}
 	if err := u.Open(); err != nil {
+		if u.sync != nil {
+			u.sync.close()
+		}
+		u.closeSegments()
+		return nil, err
+	}
+	return u, nil
+}
+
+// NewUndoLog create log with filename, panics if it fails. See OpenUndoLog.
+func NewUndoLog(name string, opts ...Options) *UndoLog {
+	var opt Options
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	u, err := OpenUndoLog(name, opt)
+	if err != nil {
 		panic("UndoLog open failed: " + err.Error())
 	}
 	return u
@@ -42,124 +158,364 @@ func NewUndoLog(name string) *UndoLog {
 
 // Open open file, return error if fail to open or analyze legacy log file
 func (l *UndoLog) Open() error {
-	var err error
-	l.file, err = os.OpenFile(l.fileName, os.O_RDWR|os.O_CREATE, 0640) //TODO: consider excl
-	if err != nil {
-		return err
-	}
-
-	if l.writeOffset, err = l.file.Seek(0, io.SeekEnd); err != nil {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = false
+	if err := l.openSegments(); err != nil {
 		return err
 	}
-	var info os.FileInfo
-	if info, err = l.file.Stat(); err != nil {
+	l.sync = newSyncer(l.opts.Sync, l.opts.SyncInterval)
+	active := l.active()
+	size, err := active.size()
+	if err != nil {
 		return err
 	}
+	l.index = make(txIndex)
 
-	l.w = bufio.NewWriter(l.file)
-	l.r = bufio.NewReader(l.file)
+	if size == 0 {
+		// new file, or a new segment whose header did not reach the disk
+		base, ending := int64(0), int64(-1)
+		if n := len(l.segments); n > 1 {
+			prev := l.segments[n-2]
+			if size, err = prev.size(); err != nil {
+				return err
+			}
+			base, ending = prev.base()+size, prev.header.EndingItemOffset
+		} else {
+			os.Remove(l.indexFileName()) // left by a removed log
+		}
+		l.header = newFileHeader(base)
+		active.header = l.header
+		l.writeOffset = l.header.NextItemOffset
+		l.readOffset = ending
+		if err = l.writeHeader(l.header); err != nil {
+			return err
+		}
+	} else if err = l.checkIntegrity(size); err != nil {
+		//legacy file
+		if err != errHeaderOffsetNotMatch || l.opts.Recovery == RecoverStrict {
+			return err
+		}
+		// try find last item
+		if err = l.recover(l.writeOffset); err != nil {
+			return err
+		}
+	}
 
-	if info.Size() == 0 {
-		// new file
-		l.header = newFileHeader()
-		return l.Write(l.header)
+	covered := l.loadIndex()
+	if covered < l.firstItemOffset() {
+		covered = l.firstItemOffset()
+	}
+	if err = l.buildIndex(covered); err != nil {
+		return err
 	}
+	return l.loadLSN()
+}
 
-	//legacy file
-	if err = l.checkIntegrity(info.Size()); err != nil {
-		if err != errHeaderOffsetNotMatch {
+// loadLSN sets the LSN of next item after the one in header and the last item
+func (l *UndoLog) loadLSN() error {
+	l.nextLSN = l.header.NextLSN
+	if l.readOffset != -1 {
+		item, err := l.readAt(l.readOffset)
+		if err != nil {
 			return err
 		}
-		// try find last item
-		if !l.recover(info.Size()) {
-			return errRecoverFail
+		if item.lsn >= l.nextLSN {
+			l.nextLSN = item.lsn + 1
 		}
 	}
-	// TODO: check if last trans not commited, if so, add to pending undo
-
+	if l.nextLSN < 1 {
+		l.nextLSN = 1
+	}
 	return nil
 }
 
-func (l *UndoLog) recover(size int64) bool {
-	// find item from header's last item offset
-	l.readOffset = l.header.EndingItemOffset
+// recover walks forward from header's last item offset to the end of file.
+// A torn item at the end of file is truncated, any other corruption is returned.
+func (l *UndoLog) recover(size int64) error {
 	endingOffset := l.header.EndingItemOffset
-	item, err := l.Read()
-	l.readOffset = item.NextOffset()
-	for l.readOffset < size && err == nil {
-		if item, err = l.Read(); err != nil {
+	nextOffset := l.header.NextItemOffset
+	if endingOffset >= l.header.NextItemOffset {
+		l.readOffset = endingOffset
+		item, err := l.read()
+		if err != nil {
+			return err
+		}
+		nextOffset = item.NextOffset()
+	} else if endingOffset < l.firstItemOffset() {
+		endingOffset = -1
+	}
+	for nextOffset < size {
+		l.readOffset = nextOffset
+		item, err := l.read()
+		if isTornWrite(err) {
+			// the write never completed, so caller never got a success from it.
+			if err = l.trunc(nextOffset); err != nil {
+				return err
+			}
+			size = nextOffset
 			break
 		}
-		endingOffset = l.readOffset
-		l.readOffset = item.NextOffset()
+		if err != nil {
+			return err
+		}
+		endingOffset = nextOffset
+		nextOffset = item.NextOffset()
 	}
-	if item.NextOffset() == size {
-		// can be recover.
-		l.header.EndingItemOffset = endingOffset
-		// update header with the right endingoffset
-		l.writeHeader(l.header)
-		return true
+	if nextOffset != size {
+		return errRecoverFail
 	}
-	return false
+	// can be recover, update header with the right endingoffset
+	l.readOffset = endingOffset
+	l.writeOffset = size
+	return l.writeHeader(l.header)
 }
 
+// checkIntegrity reads header of active segment and checks its last item against size of file
 func (l *UndoLog) checkIntegrity(size int64) error {
 	var err error
 	l.header, err = l.readHeader()
 	if err != nil {
 		return err
 	}
+	l.active().header = l.header
+	l.writeOffset = l.active().base() + size
+	if l.header.EndingItemOffset < l.header.NextItemOffset {
+		// no item recorded in this segment, ending item is in a previous one if any
+		l.readOffset = l.header.EndingItemOffset
+		if l.readOffset < l.firstItemOffset() {
+			l.readOffset = -1
+		}
+		if l.writeOffset != l.header.NextItemOffset {
+			return errHeaderOffsetNotMatch
+		}
+		return nil
+	}
 	l.readOffset = l.header.EndingItemOffset
-	if item, err := l.Read(); err != nil {
+	if item, err := l.read(); err != nil {
+		if isTornWrite(err) {
+			return errHeaderOffsetNotMatch
+		}
 		return err
-	} else if size != item.NextOffset() {
+	} else if l.writeOffset != item.NextOffset() {
 		return errHeaderOffsetNotMatch
 	}
 
 	return nil
 }
 
-// Close update header of file and close
+// Close update header of file and close, later calls fail with ErrLogClosed
 func (l *UndoLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
 	l.writeHeader(l.header)
-	l.file.Close()
+	if l.indexFile {
+		l.saveIndex()
+	}
+	l.sync.close()
+	l.closeSegments()
 }
 
-// Write write&flush an item to file
+// Write write&flush an item to file, a new segment is started if active one is full
 func (l *UndoLog) Write(item fromToBinary) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	if l.isFull() {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
 	l.seekForWrite()
-	length, err := item.ToBinary(l.w, l.writeOffset, l.readOffset)
+	undoItem, isItem := item.(*UndoItem)
+	if isItem && hasLSN(l.header.Version) {
+		undoItem.lsn = l.nextLSN
+	}
+	length, err := item.ToBinary(l.w, l.header.Version, l.writeOffset, l.readOffset)
+	if isItem && err == nil {
+		l.index.add(l.writeOffset, undoItem)
+		l.resolvePending(undoItem)
+		if undoItem.lsn != 0 {
+			l.nextLSN++
+		}
+	}
 	l.readOffset = l.writeOffset
 	l.writeOffset += length
 	if err != nil {
 		return err
 	}
-	err = l.w.Flush()
-	return err
+	if err = l.w.Flush(); err != nil {
+		return err
+	}
+	var cmd cmdType
+	if isItem {
+		cmd = undoItem.Cmd
+	}
+	return l.sync.wrote(l.file, l.writeOffset, cmd)
 }
 
 func (l *UndoLog) seekForWrite() {
-	l.writeOffset, _ = l.file.Seek(0, io.SeekEnd)
+	size, _ := l.file.Seek(0, io.SeekEnd)
+	l.writeOffset = l.active().base() + size
 }
-func (l *UndoLog) seekForRead() bool {
-	if l.readOffset == -1 {
-		return false
+
+// trunc discards everything from pos to the end of log. Segments left without
+// any item are removed, except the first one.
+func (l *UndoLog) trunc(pos int64) error {
+	l.dropIndexFile()
+	for len(l.segments) > 1 && pos <= l.header.NextItemOffset {
+		end := l.active().base() // end of previous segment
+		if err := l.dropActive(); err != nil {
+			return err
+		}
+		if pos > end {
+			pos = end
+		}
 	}
-	if _, err := l.file.Seek(l.readOffset, io.SeekStart); err != nil {
-		return false
+	l.writeOffset = pos
+	l.sync.truncated(l.file, pos)
+	return l.file.Truncate(pos - l.active().base())
+}
+
+// Purge discard all undo log, segments are deleted but the first file, legacy file is upgraded to the current version
+func (l *UndoLog) Purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
 	}
-	return true
+	l.purge()
 }
-func (l *UndoLog) trunc(pos int64) error {
-	return l.file.Truncate(pos)
+
+// LastCheckpoint returns LSN of the last checkpoint item, false if there is none
+func (l *UndoLog) LastCheckpoint() (int64, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return -1, false, ErrLogClosed
+	}
+	offset, ok, err := l.lastCheckpoint()
+	if err != nil || !ok {
+		return -1, ok, err
+	}
+	item, err := l.readAt(offset)
+	if err != nil {
+		return -1, false, err
+	}
+	return item.lsn, true, nil
 }
 
-// Purge discard all undo log in current file
-func (l *UndoLog) Purge() {
+func (l *UndoLog) lastCheckpoint() (int64, bool, error) {
+	for offset := l.readOffset; offset != -1; {
+		item, err := l.readAt(offset)
+		if err != nil {
+			return -1, false, err
+		}
+		if item.Cmd == checkpoint {
+			return offset, true, nil
+		}
+		offset = item.PrevOffset()
+	}
+	return -1, false, nil
+}
+
+// NextLSN returns LSN of the item to be written next
+func (l *UndoLog) NextLSN() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.nextLSN
+}
+
+// OffsetOf returns offset of the item with lsn. Items are searched from the
+// end of log backward, recent ones are found first.
+func (l *UndoLog) OffsetOf(lsn int64) (int64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return -1, ErrLogClosed
+	}
+	return l.offsetOf(lsn)
+}
+
+func (l *UndoLog) offsetOf(lsn int64) (int64, error) {
+	for offset := l.readOffset; offset != -1; {
+		item, err := l.readAt(offset)
+		if err != nil {
+			return -1, err
+		}
+		if item.lsn == lsn {
+			return offset, nil
+		}
+		if item.lsn < lsn {
+			break // LSNs only grow, items written before version 4 have none
+		}
+		offset = item.PrevOffset()
+	}
+	return -1, ErrUnknownLSN
+}
+
+// lastOffset returns offset of the last item, -1 if log is empty
+func (l *UndoLog) lastOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.readOffset
+}
+
+// PurgeToCheckpoint discards items older than the last checkpoint item. If
+// nothing follows the checkpoint and every transcation is ended, the whole log
+// is purged, otherwise the log is rewritten from it as PurgeBefore does.
+func (l *UndoLog) PurgeToCheckpoint() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	offset, ok, err := l.lastCheckpoint()
+	if err != nil || !ok {
+		return err
+	}
+	if offset == l.readOffset && len(l.index.uncommited()) == 0 {
+		l.purge()
+		return nil
+	}
+	item, err := l.readAt(offset)
+	if err != nil {
+		return err
+	}
+	return l.purgeBefore(item.lsn)
+}
+
+func (l *UndoLog) purge() {
+	l.dropIndexFile()
+	for _, s := range l.segments[1:] {
+		s.file.Close()
+		os.Remove(s.path)
+	}
+	s := l.segments[0]
+	if !l.isBaseFile(s.path) {
+		s.file.Close()
+		os.Remove(s.path)
+		s.path = l.fileName
+		s.file, _ = os.OpenFile(l.fileName, os.O_RDWR|os.O_CREATE, l.fileMode())
+	}
+	s.header = newFileHeader(0)
+	l.segments = l.segments[:1]
+	l.file = s.file
+	l.header = s.header
+	l.w.Reset(l.file)
 	l.writeOffset = l.header.NextOffset()
 	l.readOffset = -1
-	l.header = newFileHeader()
+	l.pending = nil
+	l.index = make(txIndex)
+	l.sync.truncated(l.file, l.writeOffset)
 	l.file.Truncate(l.writeOffset)
+	l.writeManifest()
 	l.writeHeader(l.header)
 }
 
@@ -169,8 +525,9 @@ func (l *UndoLog) writeHeader(*fileHeader) error {
 	}
 	l.header.EndingItemOffset = l.readOffset // update header's ending offset
 	l.header.Size = l.writeOffset
+	l.header.NextLSN = l.nextLSN
 
-	if _, err := l.header.ToBinary(l.w, 0, 0); err != nil { // last 2 param will be ignored
+	if _, err := l.header.ToBinary(l.w, l.header.Version, 0, 0); err != nil { // last 3 param will be ignored
 		return err
 	}
 	if err := l.w.Flush(); err != nil {
@@ -180,13 +537,14 @@ func (l *UndoLog) writeHeader(*fileHeader) error {
 }
 
 func (l *UndoLog) readHeader() (*fileHeader, error) {
-	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
-		return nil, err
-	}
+	return l.readSegmentHeader(l.file)
+}
 
+func (l *UndoLog) readSegmentHeader(file *os.File) (*fileHeader, error) {
+	r := io.NewSectionReader(file, 0, headerSize(constVERSION))
 	header := fileHeader{}
-	if _, err := header.FromBinary(l.r); err != nil {
-		return nil, err
+	if _, err := header.FromBinary(r, 0); err != nil { // version is read from the header itself
+		return nil, newCorruptionError(0, err)
 	}
 
 	if !checkFileHeader(&header) {
@@ -198,43 +556,190 @@ func (l *UndoLog) readHeader() (*fileHeader, error) {
 
 // Read read file till we get a whole item, return nil if nothing to read
 func (l *UndoLog) Read() (*UndoItem, error) {
-	if !l.seekForRead() {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	return l.read()
+}
+
+func (l *UndoLog) read() (*UndoItem, error) {
+	if l.readOffset == -1 {
 		return nil, nil
 	}
-	l.r.Reset(l.file)
-	item := UndoItem{}
-	var err error
-	l.prevOffset, err = item.FromBinary(l.r)
+	return l.readAt(l.readOffset)
+}
 
-	if err != nil {
-		return nil, err
+// readAt read the item at offset, readOffset and writeOffset are left untouched.
+// It does not move file offset, so that readers can run at the same time.
+func (l *UndoLog) readAt(offset int64) (*UndoItem, error) {
+	s := l.segmentAt(offset)
+	if s == nil {
+		return nil, errOffsetOutOfRange
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(s.file, offset-s.base(), maxItemSize), 128)
+	item := UndoItem{}
+	if _, err := item.FromBinary(r, s.header.Version); err != nil {
+		return nil, newCorruptionError(offset, err)
+	}
+	switch item.Cmd {
+	case write, commit, abort, begin, savepoint, revert, delta, checkpoint, rollbackTo:
+	default:
+		return nil, newCorruptionError(offset, errUnknownItem)
+	}
+	if item.prev < l.firstItemOffset() {
+		item.prev = -1 // legacy files point the first item back to the header, or its segment is deleted
+	}
+	if next := l.segmentAt(item.next); next != nil && item.next < next.header.NextItemOffset {
+		item.next = next.header.NextItemOffset // the last item of a segment points to header of the next one
 	}
 	return &item, nil
 }
 
-// Pop pop and remove the prev UndoItem from file
+// Pop pop and remove the last UndoItem from file
 func (l *UndoLog) Pop() error {
+	_, err := l.PopItem()
+	return err
+}
+
+// PopItem pop and return the last UndoItem, unlike Read followed by Pop, no
+// other Write can come in between. return nil if nothing to pop.
+func (l *UndoLog) PopItem() (*UndoItem, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	if l.readOffset == -1 {
+		return nil, errOffsetOutOfRange
+	}
+	return l.pop()
+}
+
+func (l *UndoLog) pop() (*UndoItem, error) {
+	item, err := l.readAt(l.readOffset)
+	if err != nil {
+		return nil, err
+	}
 	if err := l.trunc(l.readOffset); err != nil {
-		return err
+		return nil, err
 	}
-	l.writeOffset = l.readOffset
-	l.readOffset = l.prevOffset
-	return nil
+	l.index.remove(l.readOffset, item)
+	if n := len(l.pending); n > 0 && l.pending[n-1].offset == l.readOffset {
+		l.pending = l.pending[:n-1]
+	}
+	l.readOffset = item.PrevOffset()
+	// header keeps NextLSN, so that LSN of the item is not given again after a crash
+	return item, l.writeHeader(l.header)
+}
+
+// resolvePending drops the pending item of a transcation once it is aborted
+func (l *UndoLog) resolvePending(item *UndoItem) {
+	if item.Cmd != commit && item.Cmd != abort {
+		return
+	}
+	for i, p := range l.pending {
+		if p.item.TranscationID == item.TranscationID {
+			l.pending = append(l.pending[:i], l.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Pending returns the first items, begin or write, of transcations found on
+// open which are not commited, in the order they were written
+func (l *UndoLog) Pending() []*UndoItem {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	items := make([]*UndoItem, 0, len(l.pending))
+	for _, p := range l.pending {
+		items = append(items, p.item)
+	}
+	return items
+}
+
+// PopPending pop and return the last pending item, return nil if nothing pending.
+// The pending item must be the last item in file.
+func (l *UndoLog) PopPending() (*UndoItem, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	n := len(l.pending)
+	if n == 0 {
+		return nil, nil
+	}
+	if l.pending[n-1].offset != l.readOffset {
+		return nil, errPendingNotLast
+	}
+	return l.pop()
 }
 
 type cmdType = int
 
 const (
-	//start cmdType = iota
 	write  cmdType = 1<<24 + constMAGIC // UDO\1 in hex, LittleEndian
 	commit cmdType = 2<<24 + constMAGIC // UDO\2 in hex, LittleEndian
-	//abort
+	abort  cmdType = 3<<24 + constMAGIC // UDO\3 in hex, LittleEndian
+	begin  cmdType = 4<<24 + constMAGIC // UDO\4 in hex, LittleEndian
+	// savepoint marks a point to roll back to within a transcation
+	savepoint cmdType = 5<<24 + constMAGIC // UDO\5 in hex, LittleEndian
+	// revert links a compensating transcation to the one it reverts
+	revert cmdType = 6<<24 + constMAGIC // UDO\6 in hex, LittleEndian
+	// delta is a write item logging signed changes of cash instead of before-images
+	delta cmdType = 7<<24 + constMAGIC // UDO\7 in hex, LittleEndian
+	// checkpoint tells that a snapshot of users covers items before it, it
+	// does not belong to any transcation
+	checkpoint cmdType = 8<<24 + constMAGIC // UDO\8 in hex, LittleEndian
+	// rollbackTo tells that the write items of its transcation after it restore
+	// the transcation to one of its savepoint items, FromID tells which
+	rollbackTo cmdType = 9<<24 + constMAGIC // UDO\9 in hex, LittleEndian
 )
 
+// hasValues tells if items of cmd carry user values, others stop at trans
+func hasValues(cmd cmdType) bool {
+	return isChange(cmd) || cmd == revert || cmd == rollbackTo
+}
+
+// isChange tells if items of cmd log a change of cash, i.e. write or delta
+func isChange(cmd cmdType) bool {
+	return cmd == write || cmd == delta
+}
+
+// itemSize returns the encoded length of an item of cmd in the given file version.
+func itemSize(cmd cmdType, version int) int64 {
+	offsetSize := int64(8)
+	if version == constVERSION1 {
+		offsetSize = 4
+	}
+	size := 4 + 2*offsetSize + 6*4
+	if !hasValues(cmd) {
+		size = 4 + 2*offsetSize + 4
+	}
+	if hasLSN(version) {
+		size += 8
+		if hasValues(cmd) {
+			size += 2 * 4
+		}
+	}
+	if hasChecksum(version) {
+		size += 4
+	}
+	return size
+}
+
 // UndoItem undo log implementation
-// cmd:4|next:4|prev:4|trans:4|from:4|fromcash:4|to:4|tocash:4|cash:4
+// version 4: cmd:4|next:8|prev:8|lsn:8|trans:4|from:4|fromcash:4|to:4|tocash:4|cash:4|fromafter:4|toafter:4|crc:4
+// version 3: same as version 4, without lsn, fromafter and toafter.
+// version 2: same as version 3, without crc.
+// version 1: same as version 2, but next and prev are 4 bytes each.
+// items other than write, delta and revert stop at trans, followed by crc in version 3 and 4.
+// delta items keep signed changes in fromcash and tocash instead of cash at begin.
+// revert items keep the reverted TranscationID in from, other values are 0.
+// crc: CRC-32C of all the bytes before it in the item.
 // prev: writeOffset of prev item. For the first item, it's -1
-// TODO: writeOffset limited to 2G so far
 type UndoItem struct {
 	Cmd           cmdType
 	TranscationID int
@@ -243,25 +748,65 @@ type UndoItem struct {
 	ToID          int
 	ToCash        int // to-user 's cash when transaction begin
 	Cash          int
-	next          int
-	prev          int
+	FromAfter     int // from-user 's cash after the transfer, write items only
+	ToAfter       int // to-user 's cash after the transfer, write items only
+	next          int64
+	prev          int64
+	lsn           int64 // log sequence number, 0 if written before version 4
 }
 
 // NextOffset offset of next item
 func (t *UndoItem) NextOffset() int64 {
-	return int64(t.next)
+	return t.next
 }
 
 // PrevOffset offset of previous item
 func (t *UndoItem) PrevOffset() int64 {
-	return int64(t.prev)
+	return t.prev
+}
+
+// LSN returns log sequence number of the item, assigned by UndoLog.Write.
+// Items written before version 4 have none, it is 0.
+func (t *UndoItem) LSN() int64 {
+	return t.lsn
+}
+
+// afterImages returns cash of both users after a write item. Items written
+// before version 4 do not keep them, they are worked out from the transfer.
+func (t *UndoItem) afterImages() (int, int) {
+	if t.lsn == 0 {
+		return t.FromCash - t.Cash, t.ToCash + t.Cash
+	}
+	return t.FromAfter, t.ToAfter
+}
+
+// Reverts returns TranscationID reverted by a revert item, -1 for other items
+func (t *UndoItem) Reverts() int {
+	if t.Cmd != revert {
+		return -1
+	}
+	return t.FromID
+}
+
+// Savepoint returns the savepoint a rollbackTo item restores to, 1 for the
+// first savepoint item of its transcation, -1 for other items
+func (t *UndoItem) Savepoint() int {
+	if t.Cmd != rollbackTo {
+		return -1
+	}
+	return t.FromID
 }
 
-// ToBinary write binary to writer, so far limited to 2G. return length of this item.
-func (t *UndoItem) ToBinary(w io.Writer, currentOffset int64, prevOffset int64) (int64, error) {
+// ToBinary write binary to writer in the layout of version. return length of this item.
+func (t *UndoItem) ToBinary(w io.Writer, version int, currentOffset int64, prevOffset int64) (int64, error) {
 	var pErr *error
 	var length int
-	wint := func(v int32) {
+	out := w
+	crc := crc32.New(crcTable)
+	if hasChecksum(version) {
+		w = io.MultiWriter(w, crc)
+	}
+	put := func(v interface{}) {
 		if pErr != nil {
 			return
 		}
@@ -270,25 +815,38 @@ func (t *UndoItem) ToBinary(w io.Writer, currentOffset int64, prevOffset int64)
 			pErr = &err
 			return
 		}
-		length += 4
+		length += binary.Size(v)
 	}
-
-	itemLength := 36
-
-	if t.Cmd == commit {
-		itemLength = 16 //TODO: how to calc size?
+	wint := func(v int) { put(int32(v)) }
+	woff := func(v int64) {
+		if version == constVERSION1 {
+			put(int32(v))
+			return
+		}
+		put(v)
 	}
 
-	wint(int32(t.Cmd))                             //cmd
-	wint(int32(currentOffset) + int32(itemLength)) //next
-	wint(int32(prevOffset))                        //prev For the first item, it's -1
-	wint(int32(t.TranscationID))
-	if t.Cmd != commit { //commit events do not need those values
-		wint(int32(t.FromID))
-		wint(int32(t.FromCash))
-		wint(int32(t.ToID))
-		wint(int32(t.ToCash))
-		wint(int32(t.Cash))
+	wint(t.Cmd)                                    //cmd
+	woff(currentOffset + itemSize(t.Cmd, version)) //next
+	woff(prevOffset)                               //prev For the first item, it's -1
+	if hasLSN(version) {
+		put(t.lsn)
+	}
+	wint(t.TranscationID)
+	if hasValues(t.Cmd) { //other events do not need those values
+		wint(t.FromID)
+		wint(t.FromCash)
+		wint(t.ToID)
+		wint(t.ToCash)
+		wint(t.Cash)
+		if hasLSN(version) {
+			wint(t.FromAfter)
+			wint(t.ToAfter)
+		}
+	}
+	if hasChecksum(version) {
+		w = out
+		put(crc.Sum32())
 	}
 	if pErr != nil {
 		return int64(length), *pErr
@@ -296,76 +854,159 @@ func (t *UndoItem) ToBinary(w io.Writer, currentOffset int64, prevOffset int64)
 	return int64(length), nil
 }
 
-// FromBinary read binary from reader, return writeOffset of the item before the one being read.
-func (t *UndoItem) FromBinary(r io.Reader) (int64, error) {
+// FromBinary read binary in the layout of version from reader, return writeOffset of the item before the one being read.
+func (t *UndoItem) FromBinary(r io.Reader, version int) (int64, error) {
 	var pErr *error
-	//var length int
-	rint := func(p *int) {
+	in := r
+	crc := crc32.New(crcTable)
+	if hasChecksum(version) {
+		r = io.TeeReader(r, crc)
+	}
+	get := func(v interface{}) {
 		if pErr != nil {
 			return
 		}
-		var value int32
-		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
 			pErr = &err
-			return
 		}
+	}
+	rint := func(p *int) {
+		var value int32
+		get(&value)
 		*p = int(value)
 	}
+	roff := func(p *int64) {
+		if version == constVERSION1 {
+			var value int32
+			get(&value)
+			*p = int64(value)
+			return
+		}
+		get(p)
+	}
 
 	var cmd int
 	rint(&cmd)
 	t.Cmd = cmdType(cmd)
-	rint(&t.next)
-	rint(&t.prev)
+	roff(&t.next)
+	roff(&t.prev)
+	if hasLSN(version) {
+		get(&t.lsn)
+	}
 	rint(&t.TranscationID)
-	if t.Cmd != commit {
+	if hasValues(t.Cmd) {
 		rint(&t.FromID)
 		rint(&t.FromCash)
 		rint(&t.ToID)
 		rint(&t.ToCash)
 		rint(&t.Cash)
+		if hasLSN(version) {
+			rint(&t.FromAfter)
+			rint(&t.ToAfter)
+		}
+	}
+	if pErr == nil && hasChecksum(version) {
+		if err := checkChecksum(in, crc.Sum32()); err != nil {
+			pErr = &err
+		}
 	}
 	if pErr != nil {
 		return 0, *pErr
 	}
-	return int64(t.prev), nil
+	return t.prev, nil
 }
 
-// magic:4|version:4|next:4|endItem:4|total:4
+// version 4: magic:4|version:4|next:8|endItem:8|total:8|nextLSN:8|crc:4
+// next: offset of the first item, it is headerSize plus the offset of the file in a segmented log.
+// nextLSN: LSN of the item to be written next, so that LSNs go on after Purge.
+// version 3: same as version 4, without nextLSN.
+// version 2: same as version 3, without crc.
+// version 1: magic:4|version:4|next:4|endItem:4|total:4
 type fileHeader struct {
 	Magic            int
 	Version          int
 	NextItemOffset   int64
 	EndingItemOffset int64
 	Size             int64
+	NextLSN          int64
 }
 
-//Next offset of next item
+// Next offset of next item
 func (h *fileHeader) NextOffset() int64 {
 	return h.NextItemOffset
 }
 
-//Prev offset of previous item
+// Prev offset of previous item
 func (h *fileHeader) PrevOffset() int64 {
 	return -1
 }
 
 const constMAGIC int = 0x006f6475 //UDO\0
-const constVERSION int = 1
 
-func newFileHeader() *fileHeader {
-	return &fileHeader{Magic: constMAGIC, Version: constVERSION, NextItemOffset: 16}
+const (
+	constVERSION1 int = 1 // 32-bit offsets
+	constVERSION2 int = 2 // 64-bit offsets
+	constVERSION3 int = 3 // 64-bit offsets, CRC-32C on every item and header
+	constVERSION4 int = 4 // LSN on every item and header, after-images on write items
+	constVERSION      = constVERSION4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// hasChecksum tells if items and header carry a crc in the given version.
+func hasChecksum(version int) bool {
+	return version >= constVERSION3
+}
+
+// hasLSN tells if items carry an LSN and write items their after-images in the given version.
+func hasLSN(version int) bool {
+	return version >= constVERSION4
+}
+
+// checkChecksum reads the stored crc from r and compares it with sum.
+func checkChecksum(r io.Reader, sum uint32) error {
+	var stored uint32
+	if err := binary.Read(r, binary.LittleEndian, &stored); err != nil {
+		return err
+	}
+	if stored != sum {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// headerSize returns the encoded length of the file header in the given version.
+func headerSize(version int) int64 {
+	switch version {
+	case constVERSION1:
+		return 20
+	case constVERSION2:
+		return 32
+	case constVERSION3:
+		return 36
+	}
+	return 44
+}
+
+// newFileHeader returns header of a file which starts at global offset base
+func newFileHeader(base int64) *fileHeader {
+	return &fileHeader{Magic: constMAGIC, Version: constVERSION, NextItemOffset: base + headerSize(constVERSION)}
 }
 
 func checkFileHeader(header *fileHeader) bool {
-	return header.Magic == constMAGIC
+	return header.Magic == constMAGIC && header.Version >= constVERSION1 && header.Version <= constVERSION4
 }
 
-// ToBinary write binary to writer, so far limited to 2G. return length of this item.
-func (h *fileHeader) ToBinary(w io.Writer, currentOffset int64, prevOffset int64) (int64, error) {
+// ToBinary write binary to writer in the layout of h.Version. return length of this item.
+func (h *fileHeader) ToBinary(w io.Writer, version int, currentOffset int64, prevOffset int64) (int64, error) {
 	var pErr *error
 	var length int
-	wint := func(v int32) {
+	out := w
+	crc := crc32.New(crcTable)
+	if hasChecksum(h.Version) {
+		w = io.MultiWriter(w, crc)
+	}
+	put := func(v interface{}) {
 		if pErr != nil {
 			return
 		}
@@ -374,15 +1015,28 @@ func (h *fileHeader) ToBinary(w io.Writer, currentOffset int64, prevOffset int64
 			pErr = &err
 			return
 		}
-		length += 4
+		length += binary.Size(v)
+	}
+	woff := func(v int64) {
+		if h.Version == constVERSION1 {
+			put(int32(v))
+			return
+		}
+		put(v)
 	}
 
-	itemLength := 20
-	wint(int32(h.Magic))            //magic
-	wint(int32(h.Version))          //version
-	wint(int32(itemLength))         //next
-	wint(int32(h.EndingItemOffset)) //ending item offset
-	wint(int32(h.Size))             //size of file
+	put(int32(h.Magic))      //magic
+	put(int32(h.Version))    //version
+	woff(h.NextItemOffset)   //next
+	woff(h.EndingItemOffset) //ending item offset
+	woff(h.Size)             //size of file
+	if hasLSN(h.Version) {
+		put(h.NextLSN)
+	}
+	if hasChecksum(h.Version) {
+		w = out
+		put(crc.Sum32())
+	}
 
 	if pErr != nil {
 		return int64(length), *pErr
@@ -390,33 +1044,48 @@ func (h *fileHeader) ToBinary(w io.Writer, currentOffset int64, prevOffset int64
 	return int64(length), nil
 }
 
-// FromBinary read binary from reader, return writeOffset of the item before the one being read.
-func (h *fileHeader) FromBinary(r io.Reader) (int64, error) {
+// FromBinary read binary from reader, the layout is decided by the version stored in header.
+func (h *fileHeader) FromBinary(r io.Reader, version int) (int64, error) {
 	var pErr *error
-	//var length int
-	rint := func(p *int) {
+	in := r
+	crc := crc32.New(crcTable)
+	r = io.TeeReader(r, crc) // version is unknown until it is read
+	get := func(v interface{}) {
 		if pErr != nil {
 			return
 		}
-		var value int32
-		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
 			pErr = &err
-			return
 		}
+	}
+	rint := func(p *int) {
+		var value int32
+		get(&value)
 		*p = int(value)
 	}
+	roff := func(p *int64) {
+		if h.Version == constVERSION1 {
+			var value int32
+			get(&value)
+			*p = int64(value)
+			return
+		}
+		get(p)
+	}
 
-	var next int
-	var ending int
-	var size int
 	rint(&h.Magic)
 	rint(&h.Version)
-	rint(&next)
-	rint(&ending)
-	rint(&size)
-	h.NextItemOffset = int64(next)
-	h.EndingItemOffset = int64(ending)
-	h.Size = int64(size)
+	roff(&h.NextItemOffset)
+	roff(&h.EndingItemOffset)
+	roff(&h.Size)
+	if hasLSN(h.Version) {
+		get(&h.NextLSN)
+	}
+	if pErr == nil && hasChecksum(h.Version) {
+		if err := checkChecksum(in, crc.Sum32()); err != nil {
+			pErr = &err
+		}
+	}
 
 	if pErr != nil {
 		return -1, *pErr
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLogWrite(t *testing.T) {
@@ -18,7 +22,7 @@ func TestLogRead(t *testing.T) {
 	os.Remove("./test.bin")
 	log := NewUndoLog("./test.bin")
 	//defer log.Close()
-	origin := UndoItem{write, 0x99, 1, 100, 3, 0, 10, 0, 0}
+	origin := UndoItem{Cmd: write, TranscationID: 0x99, FromID: 1, FromCash: 100, ToID: 3, ToCash: 0, Cash: 10}
 	if err := log.Write(&origin); err != nil {
 		t.Error(err)
 	}
@@ -49,10 +53,10 @@ func TestLogWriteRead(t *testing.T) {
 	log := NewUndoLog("./test.bin")
 	defer log.Close()
 	origins := []UndoItem{
-		UndoItem{write, 0x1, 1, 100, 2, 0, 10, 0, 0},
-		UndoItem{write, 0x2, 2, 100, 3, 0, 20, 0, 0},
-		UndoItem{write, 0x3, 3, 100, 4, 0, 30, 0, 0},
-		UndoItem{write, 0x4, 5, 100, 6, 0, 40, 0, 0},
+		UndoItem{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10},
+		UndoItem{Cmd: write, TranscationID: 0x2, FromID: 2, FromCash: 100, ToID: 3, ToCash: 0, Cash: 20},
+		UndoItem{Cmd: write, TranscationID: 0x3, FromID: 3, FromCash: 100, ToID: 4, ToCash: 0, Cash: 30},
+		UndoItem{Cmd: write, TranscationID: 0x4, FromID: 5, FromCash: 100, ToID: 6, ToCash: 0, Cash: 40},
 	}
 
 	for _, item := range origins {
@@ -71,6 +75,7 @@ func TestLogWriteRead(t *testing.T) {
 		//take care of internal field, they dont need to be the same
 		item.prev = 0
 		item.next = 0
+		item.lsn = 0
 		if *item != origins[len(origins)-idx-1] {
 			t.Errorf("item read does not match origin")
 		}
@@ -94,6 +99,7 @@ func TestLogWriteRead(t *testing.T) {
 
 	item.next = 0
 	item.prev = 0
+	item.lsn = 0
 	if *item != origins[3] {
 		t.Errorf("item read does not match origin")
 	}
@@ -120,10 +126,10 @@ func TestLogFileHeader(t *testing.T) {
 	os.Remove("./test.bin")
 	log := NewUndoLog("./test.bin")
 	origins := []UndoItem{
-		UndoItem{write, 0x1, 1, 100, 2, 0, 10, 0, 0},
-		UndoItem{write, 0x2, 2, 100, 3, 0, 20, 0, 0},
-		UndoItem{write, 0x3, 3, 100, 4, 0, 30, 0, 0},
-		UndoItem{write, 0x4, 5, 100, 6, 0, 40, 0, 0},
+		UndoItem{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10},
+		UndoItem{Cmd: write, TranscationID: 0x2, FromID: 2, FromCash: 100, ToID: 3, ToCash: 0, Cash: 20},
+		UndoItem{Cmd: write, TranscationID: 0x3, FromID: 3, FromCash: 100, ToID: 4, ToCash: 0, Cash: 30},
+		UndoItem{Cmd: write, TranscationID: 0x4, FromID: 5, FromCash: 100, ToID: 6, ToCash: 0, Cash: 40},
 	}
 
 	for _, item := range origins {
@@ -138,7 +144,7 @@ func TestLogFileHeader(t *testing.T) {
 		t.Error("endingItemOffset does not match size")
 	}
 
-	another := &UndoItem{write, 0x5, 6, 100, 7, 0, 40, 0, 0}
+	another := &UndoItem{Cmd: write, TranscationID: 0x5, FromID: 6, FromCash: 100, ToID: 7, ToCash: 0, Cash: 40}
 	log.Write(another)
 	log.file.Close()
 
@@ -148,3 +154,310 @@ func TestLogFileHeader(t *testing.T) {
 	}
 	log.Close()
 }
+
+func TestLogLegacyVersion(t *testing.T) {
+	os.Remove("./test.bin")
+	origin := UndoItem{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10}
+	f, err := os.Create("./test.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := &fileHeader{Magic: constMAGIC, Version: constVERSION1,
+		NextItemOffset:   headerSize(constVERSION1),
+		EndingItemOffset: headerSize(constVERSION1),
+		Size:             headerSize(constVERSION1) + itemSize(write, constVERSION1)}
+	header.ToBinary(f, constVERSION1, 0, 0)
+	origin.ToBinary(f, constVERSION1, headerSize(constVERSION1), 0)
+	f.Close()
+
+	log := NewUndoLog("./test.bin")
+	if log.header.Version != constVERSION1 {
+		t.Errorf("legacy header version is %d", log.header.Version)
+	}
+	another := UndoItem{Cmd: write, TranscationID: 0x2, FromID: 2, FromCash: 100, ToID: 3, ToCash: 0, Cash: 20}
+	if err := log.Write(&another); err != nil {
+		t.Error(err)
+	}
+	log.Close()
+
+	log = NewUndoLog("./test.bin")
+	defer log.Close()
+	for _, want := range []UndoItem{another, origin} {
+		item, err := log.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.next = 0
+		item.prev = 0
+		if *item != want {
+			t.Errorf("legacy item read does not match origin")
+		}
+		if err := log.Pop(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestItemLargeOffset(t *testing.T) {
+	var buf bytes.Buffer
+	origin := UndoItem{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10}
+	const offset = int64(3) << 30 // beyond 2G
+	if _, err := origin.ToBinary(&buf, constVERSION, offset, offset-1); err != nil {
+		t.Fatal(err)
+	}
+	item := UndoItem{}
+	prev, err := item.FromBinary(&buf, constVERSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev != offset-1 || item.NextOffset() != offset+itemSize(write, constVERSION) {
+		t.Errorf("offsets over 2G are not kept, next %d prev %d", item.NextOffset(), prev)
+	}
+}
+
+func TestLogChecksum(t *testing.T) {
+	os.Remove("./test.bin")
+	log := NewUndoLog("./test.bin")
+	first := UndoItem{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10}
+	second := UndoItem{Cmd: write, TranscationID: 0x2, FromID: 2, FromCash: 100, ToID: 3, ToCash: 0, Cash: 20}
+	log.Write(&first)
+	log.Write(&second)
+	secondOffset := log.readOffset
+	log.Close()
+
+	// flip a bit of the cash of the second item
+	f, _ := os.OpenFile("./test.bin", os.O_RDWR, 0640)
+	f.WriteAt([]byte{0xff}, secondOffset+itemSize(write, constVERSION)-8)
+	f.Close()
+
+	if err := (&UndoLog{fileName: "./test.bin"}).Open(); err == nil {
+		t.Fatal("open a corrupted file without error")
+	}
+	log = &UndoLog{fileName: "./test.bin"}
+	log.file, _ = os.OpenFile("./test.bin", os.O_RDWR, 0640)
+	log.header, _ = log.readHeader()
+	log.segments = []*segment{{path: "./test.bin", file: log.file, header: log.header}}
+	log.readOffset = secondOffset
+	_, err := log.Read()
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("expect CorruptionError, got %v", err)
+	}
+	if corruption.Offset != secondOffset || corruption.Err != errChecksumMismatch {
+		t.Errorf("wrong corruption reported: %v", corruption)
+	}
+	log.file.Close()
+}
+
+func TestLogTornWrite(t *testing.T) {
+	os.Remove("./test.bin")
+	log := NewUndoLog("./test.bin")
+	origin := UndoItem{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10}
+	log.Write(&origin)
+	log.Close()
+	size := headerSize(constVERSION) + itemSize(write, constVERSION)
+
+	// half of an item reached the disk
+	var buf bytes.Buffer
+	(&UndoItem{Cmd: write, TranscationID: 0x2}).ToBinary(&buf, constVERSION, size, size-itemSize(write, constVERSION))
+	f, _ := os.OpenFile("./test.bin", os.O_RDWR|os.O_APPEND, 0640)
+	f.Write(buf.Bytes()[:buf.Len()/2])
+	f.Close()
+
+	log = NewUndoLog("./test.bin")
+	defer log.Close()
+	if info, _ := log.file.Stat(); info.Size() != size {
+		t.Errorf("torn item is not truncated, size %d", info.Size())
+	}
+	item, err := log.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.next = 0
+	item.prev = 0
+	if *item != origin {
+		t.Errorf("item read does not match origin")
+	}
+}
+
+func TestLogReopenEmpty(t *testing.T) {
+	os.Remove("./test.bin")
+	log := NewUndoLog("./test.bin")
+	log.Close()
+	log = NewUndoLog("./test.bin")
+	defer log.Close()
+	if item, err := log.Read(); item != nil || err != nil {
+		t.Errorf("empty log returns %v, %v", item, err)
+	}
+}
+
+func TestOpenUndoLogOptions(t *testing.T) {
+	os.Remove("./test.bin")
+	log, err := OpenUndoLog("./test.bin", Options{Exclusive: true, FileMode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := log.file.Stat(); info.Mode().Perm() != 0600 {
+		t.Errorf("file mode is %v", info.Mode().Perm())
+	}
+	defer os.Remove("./test.bin.idx")
+	if err := log.SaveIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat("./test.bin.idx"); info.Mode().Perm() != 0600 {
+		t.Errorf("index file mode is %v", info.Mode().Perm())
+	}
+	log.Write(&UndoItem{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10})
+	log.file.Close() // header is not updated
+	size := headerSize(constVERSION) + itemSize(write, constVERSION)
+
+	if _, err := OpenUndoLog("./test.bin", Options{Exclusive: true}); !os.IsExist(err) {
+		t.Errorf("exclusive open of an existing log returns %v", err)
+	}
+	if _, err := OpenUndoLog("./test.bin", Options{Recovery: RecoverStrict}); err != errHeaderOffsetNotMatch {
+		t.Errorf("strict open of a log not closed returns %v", err)
+	}
+	if info, _ := os.Stat("./test.bin"); info.Size() != size {
+		t.Error("strict open changes the file")
+	}
+
+	os.WriteFile("./test.bin", []byte("not an undo log, not at all"), 0640)
+	if log, err = OpenUndoLog("./test.bin", Options{}); err == nil || log != nil {
+		t.Errorf("open a damaged file returns %v, %v", log, err)
+	}
+}
+
+func TestLogConcurrent(t *testing.T) {
+	removeLog("./test.bin")
+	defer removeLog("./test.bin")
+	log := NewUndoLog("./test.bin", Options{SegmentSize: 4096, Sync: SyncGroupCommit})
+
+	const writers, count = 4, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				id := w*count + i + 1
+				if err := log.Write(&UndoItem{Cmd: write, TranscationID: id, FromID: w, FromCash: 100, ToID: w + 1, ToCash: 0, Cash: 10}); err != nil {
+					t.Error(err)
+					return
+				}
+				log.Write(&UndoItem{Cmd: commit, TranscationID: id})
+				log.WaitSync()
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := log.Read(); err != nil && err != ErrLogClosed {
+					t.Error(err)
+				}
+				log.Lookup(1)
+				// a walk must see a consistent chain of items
+				cursor := log.Cursor()
+				var prev int64 = -1
+				for item, err := cursor.SeekStart(); item != nil; item, err = cursor.Next() {
+					if err != nil {
+						if err != ErrLogClosed {
+							t.Error(err)
+						}
+						break
+					}
+					if item.PrevOffset() != prev {
+						t.Errorf("item at %d points back to %d, not %d", cursor.Offset(), item.PrevOffset(), prev)
+					}
+					prev = cursor.Offset()
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	cursor := log.Cursor()
+	n := 0
+	for item, _ := cursor.SeekStart(); item != nil; item, _ = cursor.Next() {
+		n++
+	}
+	if n != writers*count*2 {
+		t.Errorf("%d items are written, want %d", n, writers*count*2)
+	}
+
+	// close while other goroutines are still calling
+	var closing sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		closing.Add(1)
+		go func() {
+			defer closing.Done()
+			for i := 0; i < 50; i++ {
+				if err := log.Write(&UndoItem{Cmd: commit, TranscationID: 1}); err != nil && err != ErrLogClosed {
+					t.Error(err)
+				}
+				if _, err := log.Read(); err != nil && err != ErrLogClosed {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	log.Close()
+	closing.Wait()
+	if err := log.Write(&UndoItem{Cmd: commit, TranscationID: 1}); err != ErrLogClosed {
+		t.Errorf("write after close returns %v", err)
+	}
+}
+
+func TestLogLSN(t *testing.T) {
+	os.Remove("./test.bin")
+	log := NewUndoLog("./test.bin")
+	items := []*UndoItem{
+		{Cmd: write, TranscationID: 0x1, FromID: 1, FromCash: 100, ToID: 2, Cash: 10, FromAfter: 90, ToAfter: 10},
+		{Cmd: commit, TranscationID: 0x1},
+	}
+	for i, item := range items {
+		log.Write(item)
+		if item.LSN() != int64(i+1) {
+			t.Errorf("item %d gets LSN %d", i, item.LSN())
+		}
+	}
+	log.Close()
+
+	log = NewUndoLog("./test.bin")
+	defer log.Close()
+	item, _ := log.Cursor().SeekStart()
+	if item.LSN() != 1 || item.FromAfter != 90 || item.ToAfter != 10 {
+		t.Errorf("item read is %v", item)
+	}
+	log.Pop()
+	log.Purge()
+	another := &UndoItem{Cmd: commit, TranscationID: 0x2}
+	log.Write(another)
+	if another.LSN() != 3 {
+		t.Errorf("LSN after purge is %d", another.LSN())
+	}
+
+	// popped, then a crash: header is not written on close
+	log.Write(&UndoItem{Cmd: commit, TranscationID: 0x3})
+	log.Pop()
+	log.file.Close()
+	log = NewUndoLog("./test.bin")
+	defer log.Close()
+	another = &UndoItem{Cmd: commit, TranscationID: 0x4}
+	log.Write(another)
+	if another.LSN() != 5 {
+		t.Errorf("LSN after pop and crash is %d", another.LSN())
+	}
+}
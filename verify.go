@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errVerifyFailed is returned by the verify subcommand when a problem is found
+var errVerifyFailed = errors.New("undo log has problems")
+
+// logProblem is a problem found by verify, offset is -1 for the header of segment
+type logProblem struct {
+	segment string
+	offset  int64
+	msg     string
+}
+
+func (p logProblem) String() string {
+	if p.offset < 0 {
+		return fmt.Sprintf("%s header: %s", p.segment, p.msg)
+	}
+	return fmt.Sprintf("%s offset %d: %s", p.segment, p.offset, p.msg)
+}
+
+// logCheck is the result of verify. Valid items are those before the first
+// problem which breaks the chain of items, repair keeps them only.
+type logCheck struct {
+	problems []logProblem
+	items    int   // items decoded
+	valid    int   // valid items
+	end      int64 // end of the last valid item
+	lastLSN  int64 // LSN of the last valid item written since version 4
+	nextLSN  int64 // NextLSN in header of the last segment
+}
+
+func (c *logCheck) report(s *segment, offset int64, format string, args ...interface{}) {
+	c.problems = append(c.problems, logProblem{s.path, offset, fmt.Sprintf(format, args...)})
+}
+
+// verify checks header of every segment, that segments follow each other,
+// and every item: its type, checksum, next and prev offsets, and that LSNs
+// grow. It goes on after a problem as long as the next item can be found.
+func (l *UndoLog) verify() (*logCheck, error) {
+	c := &logCheck{end: l.firstItemOffset()}
+	valid := true
+	prev, prevLSN := int64(-1), int64(0) // of the last item decoded
+	prevEnd := int64(0)                  // end of the previous segment file
+	for i, s := range l.segments {
+		h := s.header
+		size, err := s.size()
+		if err != nil {
+			return nil, err
+		}
+		end := s.base() + size
+		if i > 0 && s.base() != prevEnd {
+			c.report(s, -1, "segment starts at %d, previous one ends at %d", s.base(), prevEnd)
+			valid = false
+		}
+		prevEnd = end
+		ending := prev
+		for offset := h.NextItemOffset; offset < end; {
+			item, err := readRaw(s, offset)
+			if err != nil {
+				var corruption *CorruptionError
+				if errors.As(err, &corruption) {
+					err = corruption.Err
+				}
+				c.report(s, offset, "%v", err)
+				valid = false
+				if item == nil {
+					break // length unknown, next item can not be found
+				}
+			}
+			c.items++
+			length := itemSize(item.Cmd, h.Version)
+			if item.prev != prev && !(prev == -1 && item.prev < l.firstItemOffset()) {
+				c.report(s, offset, "prev is %d, previous item is at %d", item.prev, prev)
+				valid = false
+			}
+			if item.next != offset+length {
+				c.report(s, offset, "next is %d, item ends at %d", item.next, offset+length)
+				valid = false
+			}
+			if item.lsn != 0 && item.lsn <= prevLSN {
+				c.report(s, offset, "lsn %d is not after %d", item.lsn, prevLSN)
+				valid = false
+			}
+			if valid {
+				c.valid++
+				c.end = offset + length
+				if item.lsn != 0 {
+					c.lastLSN = item.lsn
+				}
+			}
+			if item.lsn != 0 {
+				prevLSN = item.lsn
+			}
+			prev, ending = offset, offset
+			offset += length
+		}
+		if h.EndingItemOffset != ending && !(ending == -1 && h.EndingItemOffset < l.firstItemOffset()) {
+			c.report(s, -1, "ending item offset is %d, last item is at %d", h.EndingItemOffset, ending)
+		}
+		if h.Size != end {
+			c.report(s, -1, "size is %d, file ends at %d", h.Size, end)
+		}
+		if hasLSN(h.Version) && h.NextLSN <= prevLSN {
+			c.report(s, -1, "next lsn is %d, lsn %d is written", h.NextLSN, prevLSN)
+		}
+		c.nextLSN = h.NextLSN
+	}
+	return c, nil
+}
+
+// rebuildHeader returns the header of a segment file whose stored header can
+// not be trusted, nil if its items fit no version. The version stored is kept
+// if it is known, otherwise it is the one the items are laid out in. The first
+// item is found from its next offset, or at prevEnd if there is none. Other
+// fields are kept as stored, verify reports them if they are wrong.
+func rebuildHeader(file *os.File, prevEnd int64) *fileHeader {
+	raw := make([]byte, headerSize(constVERSION))
+	n, _ := file.ReadAt(raw, 0)
+	raw = raw[:n]
+	if len(raw) < 8 {
+		return nil
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil
+	}
+	versions := []int{constVERSION4, constVERSION3, constVERSION2, constVERSION1}
+	if v := int(int32(binary.LittleEndian.Uint32(raw[4:]))); v >= constVERSION1 && v <= constVERSION {
+		versions = []int{v}
+	}
+	for _, v := range versions {
+		first, ok := probeItems(file, v, size)
+		if !ok || int64(len(raw)) < headerSize(v) {
+			continue
+		}
+		// fields as stored, in the layout of v; the checksum fails anyway
+		stored := append([]byte(nil), raw[:headerSize(v)]...)
+		binary.LittleEndian.PutUint32(stored[4:], uint32(v))
+		h := &fileHeader{}
+		h.FromBinary(bytes.NewReader(stored), 0)
+		h.Magic, h.Version = constMAGIC, v
+		h.NextItemOffset = prevEnd + headerSize(v)
+		if first >= 0 {
+			h.NextItemOffset = first
+		}
+		return h
+	}
+	return nil
+}
+
+// probeItems tells if items of a segment file of size are laid out in version,
+// i.e. the first item decodes and the second, if any, points back to it.
+// Returns offset of the first item, -1 if there is none.
+func probeItems(file *os.File, version int, size int64) (int64, bool) {
+	at := headerSize(version)
+	if size <= at {
+		return -1, size == at
+	}
+	decode := func(at int64) (*UndoItem, bool) {
+		item := &UndoItem{}
+		_, err := item.FromBinary(io.NewSectionReader(file, at, maxItemSize), version)
+		_, known := cmdNames[item.Cmd]
+		return item, err == nil && known
+	}
+	item, ok := decode(at)
+	if !ok {
+		return -1, false
+	}
+	length := itemSize(item.Cmd, version)
+	first := item.next - length
+	if first < at {
+		return -1, false
+	}
+	if at+length < size {
+		second, ok := decode(at + length)
+		return first, ok && second.prev == first
+	}
+	return first, at+length == size
+}
+
+// verifyLog opens the log at path read only and verifies it, problems of
+// headers rebuilt on open come first
+func verifyLog(path string) (*UndoLog, *logCheck, error) {
+	l, problems, err := openLogReadOnly(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := l.verify()
+	if err != nil {
+		l.closeSegments()
+		return nil, nil, err
+	}
+	c.problems = append(problems, c.problems...)
+	return l, c, nil
+}
+
+func (c *logCheck) print(w io.Writer, l *UndoLog) {
+	for _, s := range l.segments {
+		printHeader(w, s)
+	}
+	for _, p := range c.problems {
+		fmt.Fprintln(w, p)
+	}
+	fmt.Fprintf(w, "%d items, %d valid, %d problems\n", c.items, c.valid, len(c.problems))
+}
+
+// runVerify is the verify subcommand: undo_log verify [file]
+func runVerify(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := defaultLogPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	l, c, err := verifyLog(path)
+	if err != nil {
+		return err
+	}
+	defer l.closeSegments()
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	c.print(w, l)
+	if len(c.problems) > 0 {
+		return errVerifyFailed
+	}
+	return nil
+}
+
+// runRepair is the repair subcommand: undo_log repair [-o file] [file]
+// Valid items of the log are copied to a new single file log, with a header
+// rebuilt for them; the log itself is left untouched.
+func runRepair(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	output := fs.String("o", "", "path of repaired log, <file>.repaired if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := defaultLogPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	if *output == "" {
+		*output = path + ".repaired"
+	}
+	if _, err := os.Stat(*output); !os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", *output, os.ErrExist)
+	}
+	l, before, err := verifyLog(path)
+	if err != nil {
+		return err
+	}
+	defer l.closeSegments()
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	fmt.Fprintln(w, "before:")
+	before.print(w, l)
+
+	// copyItems reads items up to writeOffset, and keeps LSNs going from nextLSN
+	l.writeOffset = before.end
+	l.nextLSN = before.lastLSN + 1
+	if before.nextLSN > l.nextLSN {
+		l.nextLSN = before.nextLSN
+	}
+	if err = l.copyItems(*output, func(*UndoItem) bool { return true }); err != nil {
+		return err
+	}
+
+	repaired, after, err := verifyLog(*output)
+	if err != nil {
+		return err
+	}
+	defer repaired.closeSegments()
+	fmt.Fprintln(w, "after:")
+	after.print(w, repaired)
+	if len(after.problems) > 0 {
+		return errVerifyFailed
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerifyRepair(t *testing.T) {
+	removeLog("./verify.bin")
+	removeLog("./verify.fixed")
+	defer removeLog("./verify.bin")
+	defer removeLog("./verify.fixed")
+	log := NewUndoLog("./verify.bin")
+	for i := 1; i <= 3; i++ {
+		log.Write(&UndoItem{Cmd: write, TranscationID: i, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10})
+		log.Write(&UndoItem{Cmd: commit, TranscationID: i})
+	}
+	log.Close()
+
+	var out bytes.Buffer
+	if err := runVerify([]string{"./verify.bin"}, &out); err != nil {
+		t.Fatalf("verify a good log returns %v\n%s", err, out.String())
+	}
+
+	// corrupt cash of the second write item, items after it are still decoded
+	second := headerSize(constVERSION) + itemSize(write, constVERSION) + itemSize(commit, constVERSION)
+	f, _ := os.OpenFile("./verify.bin", os.O_RDWR, 0)
+	f.WriteAt([]byte{0xff}, second+itemSize(write, constVERSION)-8)
+	f.Close()
+	out.Reset()
+	if err := runVerify([]string{"./verify.bin"}, &out); err != errVerifyFailed {
+		t.Fatalf("verify a corrupt log returns %v", err)
+	}
+	if !strings.Contains(out.String(), "checksum mismatch") || !strings.Contains(out.String(), "6 items, 2 valid, 1 problems") {
+		t.Errorf("verify reports\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runRepair([]string{"-o", "./verify.fixed", "./verify.bin"}, &out); err != nil {
+		t.Fatalf("repair returns %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "after:") || !strings.Contains(out.String(), "2 items, 2 valid, 0 problems") {
+		t.Errorf("repair reports\n%s", out.String())
+	}
+	if err := runRepair([]string{"-o", "./verify.fixed", "./verify.bin"}, &out); !errors.Is(err, os.ErrExist) {
+		t.Errorf("repair over an existing file returns %v", err)
+	}
+	fixed, err := OpenUndoLog("./verify.fixed", Options{Recovery: RecoverStrict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fixed.Close()
+	if item, err := fixed.Read(); err != nil || item.Cmd != commit || item.TranscationID != 1 {
+		t.Errorf("last item repaired is %v, %v", item, err)
+	}
+	if fixed.NextLSN() != 7 {
+		t.Errorf("next lsn of repaired log is %d", fixed.NextLSN())
+	}
+}
+
+func TestRepairHeader(t *testing.T) {
+	removeLog("./verify.bin")
+	removeLog("./verify.fixed")
+	defer removeLog("./verify.bin")
+	defer removeLog("./verify.fixed")
+	log := NewUndoLog("./verify.bin")
+	for i := 1; i <= 3; i++ {
+		log.Write(&UndoItem{Cmd: write, TranscationID: i, FromID: 1, FromCash: 100, ToID: 2, ToCash: 0, Cash: 10})
+		log.Write(&UndoItem{Cmd: commit, TranscationID: i})
+	}
+	log.Close()
+
+	// a byte of size, then a byte of version too, which is probed from items
+	for _, at := range []int64{24, 4} {
+		removeLog("./verify.fixed")
+		f, _ := os.OpenFile("./verify.bin", os.O_RDWR, 0)
+		f.WriteAt([]byte{0x7f}, at)
+		f.Close()
+
+		var out bytes.Buffer
+		if err := runVerify([]string{"./verify.bin"}, &out); err != errVerifyFailed {
+			t.Fatalf("verify a log with corrupt header at %d returns %v\n%s", at, err, out.String())
+		}
+		if !strings.Contains(out.String(), "header: checksum mismatch") || !strings.Contains(out.String(), "header: size is") ||
+			!strings.Contains(out.String(), "6 items, 6 valid, 2 problems") {
+			t.Errorf("verify a log with corrupt header at %d reports\n%s", at, out.String())
+		}
+
+		out.Reset()
+		if err := runRepair([]string{"-o", "./verify.fixed", "./verify.bin"}, &out); err != nil {
+			t.Fatalf("repair a log with corrupt header at %d returns %v\n%s", at, err, out.String())
+		}
+		if !strings.Contains(out.String(), "6 items, 6 valid, 0 problems") {
+			t.Errorf("repair a log with corrupt header at %d reports\n%s", at, out.String())
+		}
+	}
+	fixed, err := OpenUndoLog("./verify.fixed", Options{Recovery: RecoverStrict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fixed.Close()
+	if item, err := fixed.Read(); err != nil || item.Cmd != commit || item.TranscationID != 3 {
+		t.Errorf("last item repaired is %v, %v", item, err)
+	}
+}
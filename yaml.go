@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errYAMLUnsupported is returned for YAML which parseYAML does not support,
+// rather than reading it in another way than YAML does
+var errYAMLUnsupported = errors.New("yaml is not supported")
+
+// yamlLine is a line of YAML without its indent and comment
+type yamlLine struct {
+	num    int // line number, from 1
+	indent int
+	text   string
+}
+
+// parseYAML parses the subset of YAML scenario files need into the values
+// encoding/json decodes to: block mappings and sequences by indent, flow
+// sequences and mappings on a single line, quoted and plain scalars, and
+// comments, with a "---" before the document. Anchors and aliases, tags,
+// multi-line strings, directives and more documents return errYAMLUnsupported.
+func parseYAML(data []byte) (interface{}, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		text := strings.TrimRight(stripYAMLComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" {
+			continue
+		}
+		if trimmed == "---" && len(lines) == 0 {
+			continue
+		}
+		if trimmed == "---" || trimmed == "..." || strings.HasPrefix(text, "--- ") || strings.HasPrefix(text, "%") {
+			return nil, fmt.Errorf("yaml line %d: %w: documents and directives", i+1, errYAMLUnsupported)
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("yaml line %d: tab in indent", i+1)
+		}
+		lines = append(lines, yamlLine{i + 1, len(text) - len(trimmed), trimmed})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(lines) {
+		return nil, fmt.Errorf("yaml line %d: unexpected indent", lines[p.i].num)
+	}
+	return v, nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int // line being parsed
+}
+
+// block parses a mapping or a sequence whose lines are at indent
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if isYAMLItem(p.lines[p.i].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	seq := []interface{}{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLItem(p.lines[p.i].text) {
+		line := &p.lines[p.i]
+		rest := strings.TrimLeft(line.text[1:], " ")
+		if rest == "" {
+			p.i++
+			v, err := p.nested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+		if _, _, ok := splitYAMLKey(rest); !ok && !isYAMLItem(rest) {
+			v, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("yaml line %d: %w", line.num, err)
+			}
+			seq = append(seq, v)
+			p.i++
+			continue
+		}
+		// the item goes on as a block at the column it starts from
+		line.indent += len(line.text) - len(rest)
+		line.text = rest
+		v, err := p.block(line.indent)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent {
+		line := p.lines[p.i]
+		if isYAMLItem(line.text) {
+			return nil, fmt.Errorf("yaml line %d: sequence item in a mapping", line.num)
+		}
+		if err := checkYAMLPlain(line.text); err != nil {
+			return nil, fmt.Errorf("yaml line %d: %w", line.num, err)
+		}
+		key, value, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("yaml line %d: key expected", line.num)
+		}
+		p.i++
+		var v interface{}
+		var err error
+		if value == "" {
+			v, err = p.nested(indent, true)
+		} else {
+			v, err = parseYAMLScalar(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("yaml line %d: %w", line.num, err)
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// nested parses the value of a key or an item left empty on its line: a block
+// indented more, or for a key, a sequence at the same indent. It is null if
+// there is none.
+func (p *yamlParser) nested(indent int, key bool) (interface{}, error) {
+	if p.i == len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.i]
+	if next.indent > indent || (key && next.indent == indent && isYAMLItem(next.text)) {
+		return p.block(next.indent)
+	}
+	return nil, nil
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits "key: value" out of quotes and brackets, value may be empty
+func splitYAMLKey(text string) (string, string, bool) {
+	i := indexYAML(text, ':', func(j int) bool { return j+1 == len(text) || text[j+1] == ' ' })
+	if i <= 0 {
+		return "", "", false
+	}
+	key := strings.TrimSpace(text[:i])
+	if k, err := parseYAMLScalar(key); err == nil {
+		key = fmt.Sprint(k)
+	}
+	return key, strings.TrimSpace(text[i+1:]), true
+}
+
+func parseYAMLScalar(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unclosed %q", s)
+		}
+		seq := []interface{}{}
+		for _, part := range splitYAMLFlow(s[1 : len(s)-1]) {
+			v, err := parseYAMLScalar(part)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	case strings.HasPrefix(s, "{"):
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("unclosed %q", s)
+		}
+		m := map[string]interface{}{}
+		for _, part := range splitYAMLFlow(s[1 : len(s)-1]) {
+			if err := checkYAMLPlain(part); err != nil {
+				return nil, err
+			}
+			key, value, ok := splitYAMLKey(part)
+			if !ok {
+				return nil, fmt.Errorf("key expected in %q", part)
+			}
+			v, err := parseYAMLScalar(value)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+		return m, nil
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unclosed %q", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	if err := checkYAMLPlain(s); err != nil {
+		return nil, err
+	}
+	switch s {
+	case "", "~", "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	return s, nil
+}
+
+// checkYAMLPlain returns errYAMLUnsupported if s, a plain scalar or a key,
+// starts with an indicator of what parseYAML does not support
+func checkYAMLPlain(s string) error {
+	if s == "" {
+		return nil
+	}
+	switch s[0] {
+	case '&', '*':
+		return fmt.Errorf("%w: anchors and aliases, %q", errYAMLUnsupported, s)
+	case '!':
+		return fmt.Errorf("%w: tags, %q", errYAMLUnsupported, s)
+	case '|', '>':
+		return fmt.Errorf("%w: multi-line strings, %q", errYAMLUnsupported, s)
+	case '?', '@', '`', '%':
+		return fmt.Errorf("%w: %q", errYAMLUnsupported, s)
+	}
+	return nil
+}
+
+// splitYAMLFlow splits items of a flow sequence or mapping at commas out of
+// quotes and brackets
+func splitYAMLFlow(s string) []string {
+	var parts []string
+	for strings.TrimSpace(s) != "" {
+		i := indexYAML(s, ',', func(int) bool { return true })
+		if i < 0 {
+			i = len(s)
+		}
+		parts = append(parts, strings.TrimSpace(s[:i]))
+		if i == len(s) {
+			break
+		}
+		s = s[i+1:]
+	}
+	return parts
+}
+
+// indexYAML returns index of the first c out of quotes and brackets for which
+// ok is true, -1 if none
+func indexYAML(s string, c byte, ok func(int) bool) int {
+	depth := 0
+	var quote byte
+	for j := 0; j < len(s); j++ {
+		switch b := s[j]; {
+		case quote != 0:
+			if b == '\\' && quote == '"' {
+				j++
+			} else if b == quote {
+				quote = 0
+			}
+		case b == '"' || b == '\'':
+			quote = b
+		case b == '[' || b == '{':
+			depth++
+		case b == ']' || b == '}':
+			depth--
+		case b == c && depth == 0 && ok(j):
+			return j
+		}
+	}
+	return -1
+}
+
+// stripYAMLComment removes a comment, a # at the beginning of line or after a
+// space, out of quotes
+func stripYAMLComment(line string) string {
+	i := indexYAML(line, '#', func(j int) bool { return j == 0 || line[j-1] == ' ' || line[j-1] == '\t' })
+	if i < 0 {
+		return line
+	}
+	return line[:i]
+}